@@ -0,0 +1,77 @@
+package rplex
+
+import "strings"
+
+// A BOM is a kind of byte order mark
+type BOM int
+
+const (
+	// BOMNone means there was no byte order mark
+	BOMNone BOM = iota
+
+	// BOMUTF8 is the UTF-8 byte order mark, EF BB BF
+	BOMUTF8
+
+	// BOMUTF16BE is the big-endian UTF-16 byte order mark, FE FF
+	BOMUTF16BE
+
+	// BOMUTF16LE is the little-endian UTF-16 byte order mark, FF FE
+	BOMUTF16LE
+)
+
+// boms are the byte order marks recognised by WithSkipBOM
+var boms = []struct {
+	mark string
+	bom  BOM
+}{
+	{"\xef\xbb\xbf", BOMUTF8},
+	{"\xfe\xff", BOMUTF16BE},
+	{"\xff\xfe", BOMUTF16LE},
+}
+
+// WithSkipBOM makes the Lexer skip a UTF-8 or UTF-16 byte order mark
+// at the start of the input, so that it doesn't end up in the first
+// token. BOM reports which one was skipped. Positions are still
+// byte offsets into the whole input, so the first token starts after
+// the mark. Skipping a UTF-16 mark doesn't make the rest of the input
+// decodable; that needs WithRuneDecoder
+func WithSkipBOM() Option {
+	return func(l *Lexer) {
+		l.skipBOM = true
+	}
+}
+
+// BOM returns the byte order mark that was skipped at the start of the
+// input by a Lexer created with WithSkipBOM. For lexers from NewReader
+// it's only known once some input has been read
+func (l *Lexer) BOM() BOM {
+	return l.bom
+}
+
+// size returns the length of the byte order mark in bytes
+func (b BOM) size() int {
+	for _, m := range boms {
+		if m.bom == b {
+			return len(m.mark)
+		}
+	}
+	return 0
+}
+
+// skipMark skips a byte order mark at the current position, which
+// must be the start. Lexers from New skip it as soon as they're
+// created, and lexers from NewReader when input is first needed
+func (l *Lexer) skipMark() {
+	l.markPending = false
+	l.fill(3)
+	for _, b := range boms {
+		if !strings.HasPrefix(l.Text, b.mark) {
+			continue
+		}
+		l.bom = b.bom
+		l.Pos = len(b.mark)
+		l.TokenStart = l.Pos
+		l.snapshotLineCol()
+		return
+	}
+}
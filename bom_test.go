@@ -0,0 +1,78 @@
+package rplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWithSkipBOM(t *testing.T) {
+	cases := []struct {
+		input string
+		bom   BOM
+	}{
+		{"\xef\xbb\xbfkey", BOMUTF8},
+		{"\xfe\xffkey", BOMUTF16BE},
+		{"\xff\xfekey", BOMUTF16LE},
+		{"key", BOMNone},
+	}
+
+	for _, c := range cases {
+		l := New(c.input, WithSkipBOM())
+		ts := l.Run(lexBenchWords)
+
+		if l.BOM() != c.bom {
+			t.Errorf("have BOM %d for %q; want %d", l.BOM(), c.input, c.bom)
+		}
+
+		if len(ts) != 1 || ts[0].Text() != "key" {
+			t.Errorf("have tokens %v for %q; want 'key'", ts, c.input)
+		}
+	}
+
+	l := NewReader(strings.NewReader("\xef\xbb\xbfa b"), WithSkipBOM())
+	ts := l.Run(lexBenchWords)
+	if l.BOM() != BOMUTF8 || len(ts) != 2 || ts[0].Text() != "a" {
+		t.Errorf("have BOM %d and tokens %v; want %d and 'a', 'b'", l.BOM(), ts, BOMUTF8)
+	}
+
+	if l.Column != 4 {
+		t.Errorf("have column %d; want 4", l.Column)
+	}
+
+	// Without the option the mark is part of the first token
+	l = New("\xef\xbb\xbfkey")
+	l.AcceptRunExcept("")
+	if l.Pending() != "\xef\xbb\xbfkey" || l.BOM() != BOMNone {
+		t.Errorf("have pending %q and BOM %d; want the mark kept", l.Pending(), l.BOM())
+	}
+}
+
+func TestWithSkipBOMHelpers(t *testing.T) {
+	l := New("\xef\xbb\xbfab\ncd", WithSkipBOM())
+	if !l.AtLineStart() {
+		t.Errorf("want the token after the mark to be at a line start")
+	}
+	if !l.AcceptString("ab\n") {
+		t.Errorf("want AcceptString to accept 'ab\\n' after the mark")
+	}
+
+	l.Backup()
+	if l.Column != 3 {
+		t.Errorf("have column %d after Backup; want 3", l.Column)
+	}
+
+	// Emitting again after UnEmit counts the column from the start
+	l.Emit(&lineColToken{})
+	l.UnEmit()
+	l.AcceptString("\n")
+	tok := &lineColToken{}
+	l.Emit(tok)
+	if tok.Text() != "ab\n" || tok.col != 1 {
+		t.Errorf("have token %q at column %d; want 'ab\\n' at column 1", tok.Text(), tok.col)
+	}
+
+	l = NewReader(strings.NewReader("\xef\xbb\xbftrue"), WithSkipBOM())
+	if !l.AcceptString("true") || l.BOM() != BOMUTF8 {
+		t.Errorf("have BOM %d and pending %q; want %d and 'true'", l.BOM(), l.Pending(), BOMUTF8)
+	}
+}
@@ -0,0 +1,130 @@
+package rplex
+
+import "strings"
+
+// A ByteLexer is a Lexer for ASCII-only or binary formats that works
+// on bytes rather than runes, so it skips the cost of decoding UTF-8.
+// It has a much smaller set of methods than a Lexer
+type ByteLexer struct {
+	Text       string  // The raw input text
+	Pos        int     // The current byte offset in the text
+	Tokens     []Token // The tokens that have been emitted
+	TokenStart int     // The starting position of the current token
+
+	width int // 1 if the last call to Next read a byte, otherwise 0
+}
+
+// A ByteLexFn is like a LexFn, but for a ByteLexer
+type ByteLexFn func(*ByteLexer) ByteLexFn
+
+// NewByteLexer returns a new ByteLexer for the provided input text
+func NewByteLexer(text string) *ByteLexer {
+	return &ByteLexer{
+		Text:   text,
+		Tokens: make([]Token, 0),
+	}
+}
+
+// Run runs the lexer and returns the lexed tokens
+func (l *ByteLexer) Run(initial ByteLexFn) []Token {
+	for lexfn := initial; lexfn != nil; {
+		lexfn = lexfn(l)
+	}
+	return l.Tokens
+}
+
+// Next gets the next byte in the input and moves past it. It
+// returns false if the end of the input has been reached
+func (l *ByteLexer) Next() (byte, bool) {
+	if l.Pos >= len(l.Text) {
+		l.width = 0
+		return 0, false
+	}
+	b := l.Text[l.Pos]
+	l.Pos++
+	l.width = 1
+	return b, true
+}
+
+// Backup moves the lexer back one byte. It can
+// only be used once per call of Next
+func (l *ByteLexer) Backup() {
+	l.Pos -= l.width
+	l.width = 0
+}
+
+// Peek returns the next byte in the input without moving
+// the current position, or false if there isn't one
+func (l *ByteLexer) Peek() (byte, bool) {
+	if l.Pos >= len(l.Text) {
+		return 0, false
+	}
+	return l.Text[l.Pos], true
+}
+
+// Ignore skips the current token
+func (l *ByteLexer) Ignore() {
+	l.TokenStart = l.Pos
+}
+
+// Emit adds the current token to the token slice and moves the
+// tokenStart pointer to the current position. If the token is
+// a PosToken its position is set too
+func (l *ByteLexer) Emit(t Token) {
+	t.SetText(l.Text[l.TokenStart:l.Pos])
+	if pt, ok := t.(PosToken); ok {
+		pt.SetPos(l.TokenStart, l.Pos)
+	}
+	l.TokenStart = l.Pos
+	l.Tokens = append(l.Tokens, t)
+}
+
+// Accept moves past the next byte if it's in the set of valid bytes
+func (l *ByteLexer) Accept(valid string) bool {
+	if l.Pos < len(l.Text) && strings.IndexByte(valid, l.Text[l.Pos]) >= 0 {
+		l.Pos++
+		return true
+	}
+	return false
+}
+
+// AcceptRun continually accepts bytes from the set of valid
+// bytes and returns how many bytes were accepted
+func (l *ByteLexer) AcceptRun(valid string) int {
+	start := l.Pos
+	for l.Accept(valid) {
+	}
+	return l.Pos - start
+}
+
+// AcceptRunFunc continually accepts bytes for as long as fn
+// returns true and returns how many bytes were accepted
+func (l *ByteLexer) AcceptRunFunc(fn func(byte) bool) int {
+	start := l.Pos
+	for l.Pos < len(l.Text) && fn(l.Text[l.Pos]) {
+		l.Pos++
+	}
+	return l.Pos - start
+}
+
+// AcceptUntil accepts bytes until it hits a delimiter byte
+// contained in the provided string. It returns false if the
+// end of the input was reached without finding one
+func (l *ByteLexer) AcceptUntil(delims string) bool {
+	for ; l.Pos < len(l.Text); l.Pos++ {
+		if strings.IndexByte(delims, l.Text[l.Pos]) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptString accepts s if the input at the
+// current position starts with it
+func (l *ByteLexer) AcceptString(s string) bool {
+	if !strings.HasPrefix(l.Text[l.Pos:], s) {
+		return false
+	}
+	l.Pos += len(s)
+	return true
+}
@@ -0,0 +1,73 @@
+package rplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func lexHeader(l *ByteLexer) ByteLexFn {
+	if _, ok := l.Peek(); !ok {
+		return nil
+	}
+
+	if !l.AcceptUntil(":") {
+		return nil
+	}
+	l.Emit(&testToken{})
+
+	l.Accept(":")
+	l.AcceptRun(" ")
+	l.Ignore()
+
+	l.AcceptUntil("\r")
+	l.Emit(&testToken{})
+
+	l.AcceptString("\r\n")
+	l.Ignore()
+	return lexHeader
+}
+
+func TestByteLexer(t *testing.T) {
+	l := NewByteLexer("Host: example.com\r\nX-Bin: \xff\xfe\r\n")
+	ts := l.Run(lexHeader)
+
+	var have []string
+	for _, tok := range ts {
+		have = append(have, tok.Text())
+	}
+
+	want := []string{"Host", "example.com", "X-Bin", "\xff\xfe"}
+	if strings.Join(have, "|") != strings.Join(want, "|") {
+		t.Errorf("have tokens %q; want %q", have, want)
+	}
+
+	l = NewByteLexer("ab")
+	if b, ok := l.Next(); !ok || b != 'a' {
+		t.Errorf("have (%q, %t); want ('a', true)", b, ok)
+	}
+	l.Backup()
+	l.Backup()
+	if l.Pos != 0 {
+		t.Errorf("have pos %d after backing up twice; want 0", l.Pos)
+	}
+
+	isLetter := func(b byte) bool {
+		return IsASCIILetter(rune(b))
+	}
+	if n := l.AcceptRunFunc(isLetter); n != 2 {
+		t.Errorf("have %d bytes accepted; want 2", n)
+	}
+
+	if _, ok := l.Next(); ok {
+		t.Errorf("want Next to be false at the end of the input")
+	}
+}
+
+var benchHeaders = strings.Repeat("Content-Type: text/plain\r\n", 100)
+
+func BenchmarkByteLexer(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewByteLexer(benchHeaders).Run(lexHeader)
+	}
+}
@@ -0,0 +1,102 @@
+package rplex
+
+import "fmt"
+
+// Severity is how serious a Diagnostic is
+type Severity int
+
+const (
+	// SeverityError is for input that could not be lexed
+	SeverityError Severity = iota
+
+	// SeverityWarning is for input that was lexed but is suspicious
+	SeverityWarning
+
+	// SeverityInfo is for anything else worth reporting
+	SeverityInfo
+)
+
+// String returns the name of the severity
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	case SeverityInfo:
+		return "info"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// A Diagnostic is a message about the input at a position
+type Diagnostic struct {
+	Severity Severity // How serious the diagnostic is
+	Pos      int      // The byte offset in the input it refers to
+	Msg      string   // The message
+}
+
+// Error returns the diagnostic formatted as a message,
+// so that a Diagnostic can be used as an error
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("%s at byte %d: %s", d.Severity, d.Pos, d.Msg)
+}
+
+// Diag records a diagnostic for the current position with
+// a message formatted according to a format specifier.
+// Recording a diagnostic does not halt lexing
+func (l *Lexer) Diag(sev Severity, format string, args ...interface{}) {
+	l.diags = append(l.diags, Diagnostic{
+		Severity: sev,
+		Pos:      l.Pos + l.Offset,
+		Msg:      fmt.Sprintf(format, args...),
+	})
+}
+
+// Diagnostics returns all of the diagnostics that
+// have been recorded, in the order they were recorded
+func (l *Lexer) Diagnostics() []Diagnostic {
+	return l.diags
+}
+
+// An ErrorToken is emitted by Errorf. Its text is the text of
+// the token that was being lexed when the error happened
+type ErrorToken struct {
+	TextToken
+	PositionedToken
+	Msg    string // The error message
+	Line   int    // The line the token starts on
+	Column int    // The column the token starts at
+}
+
+// SetLineCol sets the line and column an ErrorToken starts at
+func (t *ErrorToken) SetLineCol(line, col int) {
+	t.Line, t.Column = line, col
+}
+
+// Error returns the message along with where the error happened,
+// so that an ErrorToken can be used as an error
+func (t *ErrorToken) Error() string {
+	return fmt.Sprintf("%d:%d: %s", t.Line, t.Column, t.Msg)
+}
+
+// Errorf emits an ErrorToken for the current token with a
+// message formatted according to a format specifier. It
+// returns a nil LexFn so that returning its result from a
+// LexFn stops lexing; to carry on, ignore the result and
+// return the next LexFn instead
+func (l *Lexer) Errorf(format string, args ...interface{}) LexFn {
+	l.Emit(&ErrorToken{Msg: fmt.Sprintf(format, args...)})
+	return nil
+}
+
+// Resync skips forward to the next rune contained in delims and
+// ignores the skipped text, so that lexing can carry on after an
+// error and more than one error can be reported. The delimiter
+// itself is not skipped. It returns false if the end of the input
+// was reached without finding one
+func (l *Lexer) Resync(delims string) bool {
+	ok := l.AcceptUntil(delims)
+	l.Ignore()
+	return ok
+}
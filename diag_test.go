@@ -0,0 +1,110 @@
+package rplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiag(t *testing.T) {
+	l := New(`"a\qb" 'c`)
+
+	l.Run(func(l *Lexer) LexFn {
+		l.Accept(`"`)
+		l.AcceptUntil(`\`)
+		l.Accept(`\`)
+		if !l.Accept(`"\nt`) {
+			l.Diag(SeverityWarning, "unknown escape sequence \\%c", l.Peek())
+		}
+		l.AcceptUntil(`'`)
+		l.Accept(`'`)
+		if !l.AcceptUntil(`'`) {
+			l.Diag(SeverityError, "unterminated string")
+		}
+		return nil
+	})
+
+	ds := l.Diagnostics()
+	if len(ds) != 2 {
+		t.Fatalf("have %d diagnostics; want 2", len(ds))
+	}
+
+	if ds[0].Severity != SeverityWarning || ds[0].Pos != 3 {
+		t.Errorf("have %s at %d; want warning at 3", ds[0].Severity, ds[0].Pos)
+	}
+
+	if ds[1].Severity != SeverityError || ds[1].Pos != len(l.Text) {
+		t.Errorf("have %s at %d; want error at %d", ds[1].Severity, ds[1].Pos, len(l.Text))
+	}
+
+	if !strings.Contains(ds[1].Error(), "unterminated string") {
+		t.Errorf("have message '%s'; want it to contain 'unterminated string'", ds[1].Error())
+	}
+}
+
+func TestErrorf(t *testing.T) {
+	l := New("ok\n  @ x")
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptRunFunc(IsASCIILetter)
+		l.Emit(&testToken{})
+		l.SkipWhitespace()
+		l.Accept("@")
+		return l.Errorf("unexpected %q", '@')
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have %d tokens; want 2", len(ts))
+	}
+
+	e, ok := ts[1].(*ErrorToken)
+	if !ok {
+		t.Fatalf("have %T; want *ErrorToken", ts[1])
+	}
+
+	if e.Text() != "@" {
+		t.Errorf("have text '%s'; want '@'", e.Text())
+	}
+
+	if start, end := e.Pos(); start != 5 || end != 6 {
+		t.Errorf("have pos (%d, %d); want (5, 6)", start, end)
+	}
+
+	if e.Error() != "2:3: unexpected '@'" {
+		t.Errorf("have error '%s'; want '2:3: unexpected '@''", e.Error())
+	}
+}
+
+func TestResync(t *testing.T) {
+	var lexStatement LexFn
+	lexStatement = func(l *Lexer) LexFn {
+		l.SkipWhitespace()
+		if l.AtEOF() {
+			return nil
+		}
+		if l.AcceptRunFunc(IsASCIILetter); l.Pos == l.TokenStart || !l.Accept(";") {
+			l.Errorf("bad statement")
+			l.Resync(";")
+			l.Accept(";")
+			l.Ignore()
+			return lexStatement
+		}
+		l.Emit(&testToken{})
+		return lexStatement
+	}
+
+	ts := New("a; b?? junk; c; 1; d").Run(lexStatement)
+
+	var have []string
+	for _, t := range ts {
+		if e, ok := t.(*ErrorToken); ok {
+			have = append(have, "error:"+e.Text())
+			continue
+		}
+		have = append(have, t.Text())
+	}
+
+	want := "a; error:b c; error: error:d"
+	if strings.Join(have, " ") != want {
+		t.Errorf("have tokens '%s'; want '%s'", strings.Join(have, " "), want)
+	}
+}
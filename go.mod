@@ -0,0 +1,3 @@
+module github.com/tomnomnom/rplex
+
+go 1.23
@@ -0,0 +1,64 @@
+package rplex
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+)
+
+// WithStateGraph makes the Lexer record each transition from one
+// LexFn to the next as it runs, so that the state machine can be
+// written out as a graph with WriteDOT
+func WithStateGraph() Option {
+	return func(l *Lexer) {
+		l.edges = make(map[[2]string]int)
+	}
+}
+
+// RegisterState gives fn a name to use in traces and graphs instead
+// of the name the runtime knows it by. LexFns are told apart by their
+// code, so closures made by the same function literal share a name
+func (l *Lexer) RegisterState(name string, fn LexFn) {
+	if l.names == nil {
+		l.names = make(map[uintptr]string)
+	}
+	l.names[reflect.ValueOf(fn).Pointer()] = name
+}
+
+// stateName returns the name fn was registered with, or
+// the name the runtime knows it by if it wasn't registered
+func (l *Lexer) stateName(fn LexFn) string {
+	if name, ok := l.names[reflect.ValueOf(fn).Pointer()]; ok {
+		return name
+	}
+	return funcName(fn)
+}
+
+// WriteDOT writes the transitions recorded by a Lexer created
+// with WithStateGraph to w as a Graphviz DOT digraph. Each edge
+// is labelled with how many times the transition happened
+func (l *Lexer) WriteDOT(w io.Writer) error {
+	edges := make([][2]string, 0, len(l.edges))
+	for e := range l.edges {
+		edges = append(edges, e)
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		if edges[i][0] != edges[j][0] {
+			return edges[i][0] < edges[j][0]
+		}
+		return edges[i][1] < edges[j][1]
+	})
+
+	if _, err := fmt.Fprintln(w, "digraph rplex {"); err != nil {
+		return err
+	}
+	for _, e := range edges {
+		_, err := fmt.Fprintf(w, "\t%q -> %q [label=\"%d\"];\n", e[0], e[1], l.edges[e])
+		if err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintln(w, "}")
+	return err
+}
@@ -0,0 +1,40 @@
+package rplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWriteDOT(t *testing.T) {
+	var lexWord, lexSpace LexFn
+	lexWord = func(l *Lexer) LexFn {
+		l.AcceptRunFunc(IsASCIILetter)
+		l.Emit(&testToken{})
+		if l.AtEOF() {
+			return nil
+		}
+		return lexSpace
+	}
+	lexSpace = func(l *Lexer) LexFn {
+		l.SkipWhitespace()
+		return lexWord
+	}
+
+	l := New("a b c", WithStateGraph())
+	l.RegisterState("word", lexWord)
+	l.RegisterState("space", lexSpace)
+	l.Run(lexWord)
+
+	var dot strings.Builder
+	if err := l.WriteDOT(&dot); err != nil {
+		t.Fatalf("have error %s; want nil", err)
+	}
+
+	want := "digraph rplex {\n" +
+		"\t\"space\" -> \"word\" [label=\"2\"];\n" +
+		"\t\"word\" -> \"space\" [label=\"2\"];\n" +
+		"}\n"
+	if dot.String() != want {
+		t.Errorf("have DOT:\n%s\nwant:\n%s", dot.String(), want)
+	}
+}
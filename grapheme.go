@@ -0,0 +1,67 @@
+package rplex
+
+import "unicode"
+
+// zeroWidthJoiner joins emoji into a single grapheme cluster
+const zeroWidthJoiner = '\u200d'
+
+// NextGrapheme reads the next grapheme cluster in the input, i.e.
+// what a reader would see as a single character, and returns its
+// text. An empty string is returned at the end of the input. The
+// clusters are an approximation of Unicode's extended grapheme
+// clusters that covers combining marks, emoji modifiers and ZWJ
+// sequences, flags and CRLF, but not the rules for conjoining
+// Hangul jamo or Indic scripts
+func (l *Lexer) NextGrapheme() string {
+	start := l.Pos
+
+	r := l.Next()
+	switch {
+	case l.Width == 0:
+		return ""
+	case r == '\r':
+		l.Accept("\n")
+		return l.Text[start:l.Pos]
+	case isRegionalIndicator(r):
+		l.AcceptIf(isRegionalIndicator)
+	}
+
+	for {
+		r := l.Next()
+		if l.Width == 0 {
+			break
+		}
+
+		if r == zeroWidthJoiner {
+			l.Next()
+			continue
+		}
+
+		if !isGraphemeExtend(r) {
+			l.Backup()
+			break
+		}
+	}
+	return l.Text[start:l.Pos]
+}
+
+// AcceptGrapheme accepts the next grapheme cluster in the input,
+// as described for NextGrapheme, and returns false if there isn't one
+func (l *Lexer) AcceptGrapheme() bool {
+	return l.NextGrapheme() != ""
+}
+
+// isRegionalIndicator returns true if r is one of the
+// runes that make up flags, which come in pairs
+func isRegionalIndicator(r rune) bool {
+	return 0x1f1e6 <= r && r <= 0x1f1ff
+}
+
+// isGraphemeExtend returns true if r extends the grapheme cluster
+// before it; i.e. if it's a combining mark, an emoji skin tone
+// modifier or a tag character as used in subdivision flags
+func isGraphemeExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		(0x1f3fb <= r && r <= 0x1f3ff) ||
+		(0xe0020 <= r && r <= 0xe007f)
+}
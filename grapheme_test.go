@@ -0,0 +1,35 @@
+package rplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNextGrapheme(t *testing.T) {
+	clusters := []string{
+		"a",
+		"e\u0301",                    // e with a combining acute accent
+		"\U0001f44d\U0001f3fd",       // thumbs up with a skin tone
+		"\U0001f469\u200d\U0001f4bb", // woman technologist
+		"\U0001f1ec\U0001f1e7",       // the UK flag
+		"\U0001f1ec\U0001f1e7",       // and again, to check pairs don't merge
+		"\r\n",
+		"\u2764\ufe0f", // heart with an emoji presentation selector
+		"z",
+	}
+
+	l := New(strings.Join(clusters, ""))
+	for i, want := range clusters {
+		if have := l.NextGrapheme(); have != want {
+			t.Errorf("have cluster %d %q; want %q", i, have, want)
+		}
+	}
+
+	if have := l.NextGrapheme(); have != "" {
+		t.Errorf("have %q at the end of the input; want ''", have)
+	}
+
+	if l.AcceptGrapheme() {
+		t.Errorf("want AcceptGrapheme to be false at the end of the input")
+	}
+}
@@ -1,19 +1,97 @@
 package rplex
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"unicode"
 	"unicode/utf8"
+	"unsafe"
 )
 
 // Lexer holds the state for lexing statements
 type Lexer struct {
-	Text       string  // The raw input text
-	Pos        int     // The current byte offset in the text
-	Width      int     // The width of the current rune in bytes
-	Cur        rune    // The rune at the current position
-	Prev       rune    // The rune at the previous position
-	Tokens     []Token // The tokens that have been emitted
-	TokenStart int     // The starting position of the current token
+	Text       string     // The raw input text
+	Pos        int        // The current byte offset in the text
+	Width      int        // The width of the current rune in bytes
+	Cur        rune       // The rune at the current position
+	Prev       rune       // The rune at the previous position
+	Tokens     []Token    // The tokens that have been emitted
+	TokenStart int        // The starting position of the current token
+	Depth      int        // The nesting depth, for use by LexFns
+	Offset     int        // Added to the positions given to PosTokens
+	DataStack  Stack[any] // Values shared between LexFns
+	Line       int        // The line number of the current position, from 1
+	Column     int        // The column of the current position in runes, from 1
+
+	opts        []Option                 // The options the Lexer was created with
+	whitespace  func() Token             // Makes whitespace tokens for SkipSpaces
+	invalid     InvalidMode              // How invalid UTF-8 in the input is handled
+	decode      func(string) (rune, int) // Decodes the next rune in the input
+	eof         func() Token             // Makes the token emitted at the end of Run
+	eofEmitted  bool                     // Whether the EOF token has been emitted
+	lastStart   int                      // The starting position of the last emitted token
+	prevStart   int                      // The starting position of the token before that, for UnEmit
+	err         error                    // The error that halted lexing, if any
+	ctx         context.Context          // Cancels lexing when run with RunContext
+	ticks       int                      // Calls to Next since ctx was last checked
+	unEmit      int                      // The token start to restore in UnEmit, or -1
+	runeLen     int                      // The cached length of the input in runes, or -1
+	buf         strings.Builder          // Accumulates text for EmitBuffered
+	lc          lineCol                  // The line and column at a recent position, for Emit
+	pool        *sync.Pool               // Provides tokens for EmitPooled
+	diags       []Diagnostic             // The diagnostics recorded with Diag
+	dedupe      func(a, b Token) bool    // Reports tokens that Emit should drop
+	trivia      string                   // Skipped text to attach to the next TriviaToken
+	reader      io.Reader                // Provides more input for lexers from NewReader
+	readErr     error                    // The error from the last read, io.EOF once all read
+	state       LexFn                    // The next LexFn for NextToken to run
+	started     bool                     // Whether NextToken has been called
+	hist        history                  // The most recently read runes and their widths
+	escape      rune                     // The escape rune for the Unescaped methods, if not a backslash
+	invalidSeen int                      // Invalid bytes before here have been reported
+	states      Stack[LexFn]             // States pushed with PushState
+	hooks       []func(Token) Token      // Registered with OnEmit
+	trace       io.Writer                // Where state transitions and tokens are logged, if anywhere
+	names       map[uintptr]string       // LexFn names from RegisterState
+	edges       map[[2]string]int        // State transitions seen, if recording them for WriteDOT
+	noProgress  bool                     // Whether to halt when LexFns stop consuming input
+	maxStalls   int                      // LexFns allowed in a row without consuming input
+	stalls      int                      // LexFns run in a row without consuming input
+	maxTokens   int                      // The most tokens that can be emitted, if not 0
+	maxTokenLen int                      // The longest a token can be in bytes, if not 0
+	maxInputLen int                      // The longest the input can be in bytes, if not 0
+	limited     bool                     // Whether WithMaxTokenLen or WithMaxInputLen was used
+	emitted     int                      // The number of tokens emitted, for WithMaxTokens
+	skipBOM     bool                     // Whether to skip a byte order mark at the start of the input
+	bom         BOM                      // The byte order mark that was skipped, if any
+	markPending bool                     // Whether a reader's input is still to be checked for a byte order mark
+	normalize   func(string) string      // Normalizes the input given to New and Reset
+	window      int                      // Bytes kept before the current position, or -1 to keep all input
+	lookahead   int                      // Runes kept before the current position by WithLookahead
+	discarded   int                      // Bytes of input discarded by WithWindow
+	cutRunes    int                      // Runes of input discarded by WithWindow
+	base        lineCol                  // The line and column at the start of Text once input is discarded
+}
+
+// An Option configures a Lexer
+type Option func(*Lexer)
+
+// WithWhitespaceTokens makes SkipSpaces emit the whitespace it
+// skips as tokens made by the factory function instead of
+// ignoring it
+func WithWhitespaceTokens(factory func() Token) Option {
+	return func(l *Lexer) {
+		l.whitespace = factory
+	}
 }
 
 // A Token is a chunk of text
@@ -38,6 +116,74 @@ func (t *TextToken) Text() string {
 	return t.text
 }
 
+// A PosToken is a Token that also records its start and end
+// byte offsets in the input
+type PosToken interface {
+	Token
+	SetPos(start, end int)
+	Pos() (start, end int)
+}
+
+// PositionedToken can be embedded alongside TextToken into custom
+// token types to meet the PosToken interface, so that Emit records
+// their start and end byte offsets
+type PositionedToken struct {
+	start, end int
+}
+
+// SetPos sets the start and end byte offsets of a PositionedToken
+func (t *PositionedToken) SetPos(start, end int) {
+	t.start, t.end = start, end
+}
+
+// Pos gets the start and end byte offsets of a PositionedToken
+func (t *PositionedToken) Pos() (int, int) {
+	return t.start, t.end
+}
+
+// A LineColToken is a Token that also records the line and
+// column that it starts at. Lines and columns start at 1, and
+// columns are counted in runes
+type LineColToken interface {
+	Token
+	SetLineCol(line, col int)
+}
+
+// A TriviaToken is a Token that can also hold the text, such as
+// whitespace and comments, that was skipped before it
+type TriviaToken interface {
+	Token
+	SetLeadingTrivia(string)
+}
+
+// A Kind identifies what sort of thing a token is, so that
+// parsers can switch on it rather than on the token's type
+type Kind int
+
+// A KindToken is a Token that also has a Kind
+type KindToken interface {
+	Token
+	SetKind(Kind)
+	Kind() Kind
+}
+
+// TypedToken can be embedded alongside TextToken into custom
+// token types to meet the KindToken interface, so that a single
+// token type can be used for every kind of token
+type TypedToken struct {
+	kind Kind
+}
+
+// SetKind sets the kind of a TypedToken
+func (t *TypedToken) SetKind(k Kind) {
+	t.kind = k
+}
+
+// Kind gets the kind of a TypedToken
+func (t *TypedToken) Kind() Kind {
+	return t.kind
+}
+
 // A LexFn does the meat of the work. It accepts a pointer
 // to a Lexer, manipulates its state in some way, e.g. accepts
 // runes and emits tokens, and then returns a new LexFn
@@ -45,138 +191,2225 @@ func (t *TextToken) Text() string {
 // no lexing is left to be done.
 type LexFn func(*Lexer) LexFn
 
+// An InvalidMode determines how Next handles bytes in the
+// input that are not valid UTF-8
+type InvalidMode int
+
+const (
+	// InvalidReplace returns utf8.RuneError for each invalid byte
+	InvalidReplace InvalidMode = iota
+
+	// InvalidSkip silently skips over invalid bytes
+	InvalidSkip
+
+	// InvalidError records an error and halts lexing
+	InvalidError
+
+	// InvalidReport returns utf8.RuneError for each invalid byte
+	// like InvalidReplace, but also records a Diagnostic for it
+	// so that the invalid input can be reported after lexing
+	InvalidReport
+
+	// InvalidToken returns utf8.RuneError for each invalid byte
+	// like InvalidReplace, but when a token holding invalid bytes
+	// is emitted with Emit, EmitText or a method that uses them,
+	// an ErrorToken with the same text is emitted in its place.
+	// Lexing carries on after the ErrorToken
+	InvalidToken
+)
+
+// WithInvalidRune sets how invalid UTF-8 in the input is handled.
+// The default is InvalidReplace
+func WithInvalidRune(mode InvalidMode) Option {
+	return func(l *Lexer) {
+		l.invalid = mode
+	}
+}
+
+// WithEOFToken makes Run emit a token made by the factory
+// function, with empty text, once lexing has finished
+func WithEOFToken(factory func() Token) Option {
+	return func(l *Lexer) {
+		l.eof = factory
+	}
+}
+
+// WithRuneDecoder makes Next decode runes from the input with
+// the provided function instead of utf8.DecodeRuneInString; e.g.
+// to lex input that is Latin-1 encoded rather than UTF-8. The
+// function must return the rune at the start of the string and
+// its width in bytes, or a width of zero for an empty string
+func WithRuneDecoder(fn func(s string) (rune, int)) Option {
+	return func(l *Lexer) {
+		l.decode = fn
+	}
+}
+
+// WithTokenPool makes EmitPooled get its tokens from the pool,
+// whose New function must return a Token. ReleaseTokens puts
+// tokens back into the pool once they are no longer needed
+func WithTokenPool(pool *sync.Pool) Option {
+	return func(l *Lexer) {
+		l.pool = pool
+	}
+}
+
+// WithDedupeConsecutive makes the Emit methods drop a token if
+// the eq function reports that it's equal to the last emitted
+// token. The text of a dropped token is not added to the last
+// token; it's discarded
+func WithDedupeConsecutive(eq func(a, b Token) bool) Option {
+	return func(l *Lexer) {
+		l.dedupe = eq
+	}
+}
+
+// WithMaxStalls makes every way of running the Lexer halt like
+// RunSafe if more than n LexFns in a row return without the
+// current position having moved
+func WithMaxStalls(n int) Option {
+	return func(l *Lexer) {
+		l.noProgress, l.maxStalls = true, n
+	}
+}
+
+// WithNormalization makes New and Reset pass the input through fn
+// before lexing it, e.g. norm.NFC.String from golang.org/x/text, so
+// that text which looks the same always lexes the same. Positions
+// are offsets into the normalized input. Input from NewReader isn't
+// normalized; wrap the reader with something like norm.NFC.Reader
+func WithNormalization(fn func(string) string) Option {
+	return func(l *Lexer) {
+		l.normalize = fn
+	}
+}
+
+// WithTrace makes the Lexer log each LexFn it runs, the input
+// each one accepts and each token that's emitted to w. It's
+// meant for debugging LexFns, so the format may change. The
+// lexers RunParallel uses for each chunk log to buffers of
+// their own, which are written to w in input order once all
+// of the chunks have been lexed
+func WithTrace(w io.Writer) Option {
+	return func(l *Lexer) {
+		l.trace = w
+	}
+}
+
+// WithEscapeRune sets the rune that AcceptUntilUnescaped and
+// AcceptUntilUnescapedStripped treat as escaping the rune after it.
+// The default is a backslash
+func WithEscapeRune(r rune) Option {
+	return func(l *Lexer) {
+		l.escape = r
+	}
+}
+
 // New returns a new Lexer for the provided input string
-func New(text string) *Lexer {
-	return &Lexer{
-		Text:       text,
-		Pos:        0,
-		TokenStart: 0,
-		Tokens:     make([]Token, 0),
+// configured with any provided options
+func New(text string, opts ...Option) *Lexer {
+	l := &Lexer{
+		Tokens: make([]Token, 0),
+		opts:   opts,
+	}
+	l.Reset(text)
+	return l
+}
+
+// Reset prepares the Lexer to lex text from the start, keeping the
+// options it was created with, its OnEmit hooks and the names given
+// to LexFns with RegisterState. The memory used by the token slice
+// is reused, so any tokens from before the Reset that are still
+// needed must be copied first
+func (l *Lexer) Reset(text string) {
+	ring := l.hist.ring
+	*l = Lexer{
+		Text:    text,
+		Tokens:  l.Tokens[:0],
+		opts:    l.opts,
+		hooks:   l.hooks,
+		names:   l.names,
+		diags:   l.diags[:0],
+		unEmit:  -1,
+		runeLen: -1,
+		window:  -1,
+		Line:    1,
+		Column:  1,
+	}
+
+	for _, opt := range l.opts {
+		opt(l)
+	}
+	l.limited = l.maxInputLen > 0 || l.maxTokenLen > 0
+
+	// The widths of runes can only be found by decoding the
+	// input again if it's decoded as UTF-8 one rune at a time
+	if l.decode != nil || l.invalid == InvalidSkip {
+		l.hist.reset(ring, max(historySize, l.lookahead))
+	}
+
+	if l.normalize != nil {
+		l.Text = l.normalize(l.Text)
+	}
+
+	if l.skipBOM {
+		l.skipMark()
+	}
+}
+
+// NewReader returns a new Lexer that reads its input from r as it
+// is needed, configured with any provided options. Input that has
+// been read is appended to Text. An error from r other than io.EOF
+// halts lexing once the input read before it is used up, and is
+// returned by Err
+func NewReader(r io.Reader, opts ...Option) *Lexer {
+	l := New("", opts...)
+	l.reader = r
+	l.markPending = l.skipBOM
+	return l
+}
+
+// minReadSize is the smallest number of bytes
+// read from the reader of a Lexer at once
+const minReadSize = 4096
+
+// fill reads from the Lexer's reader, if it has one, until at least n
+// bytes after the current position are available or no more input can
+// be read. It returns false if fewer than n bytes are available
+func (l *Lexer) fill(n int) bool {
+	if l.markPending {
+		l.skipMark()
+	}
+
+	for len(l.Text)-l.Pos < n {
+		if l.reader == nil || l.readErr != nil {
+			return false
+		}
+
+		if l.window >= 0 {
+			l.discard()
+		}
+
+		// Reading at least as much as has been read already keeps
+		// the cost of copying Text when it grows linear overall
+		size := len(l.Text)
+		if size < minReadSize {
+			size = minReadSize
+		}
+		buf := make([]byte, size)
+
+		read, err := io.ReadAtLeast(l.reader, buf, 1)
+		l.Text += string(buf[:read])
+		l.runeLen = -1
+
+		if err != nil {
+			l.readErr = err
+		}
+	}
+	return true
+}
+
+// fillAll reads all of the remaining input from
+// the Lexer's reader, if it has one
+func (l *Lexer) fillAll() {
+	for l.fill(len(l.Text) - l.Pos + 1) {
 	}
 }
 
 // Run runs the lexer and returns the lexed tokens
 func (l *Lexer) Run(initial LexFn) []Token {
 
-	for lexfn := initial; lexfn != nil; {
-		lexfn = lexfn(l)
+	for lexfn := initial; lexfn != nil && l.err == nil; {
+		lexfn = l.step(lexfn)
 	}
+	l.emitEOF()
 	return l.Tokens
 }
 
-// Next gets the next rune in the input and updates the lexer state
-func (l *Lexer) Next() rune {
-	r, w := utf8.DecodeRuneInString(l.Text[l.Pos:])
+// step runs a single LexFn and returns the next one, logging
+// what it did if the Lexer was created with WithTrace, recording
+// the transition if it was created with WithStateGraph and
+// checking it consumed input if it was created with WithMaxStalls
+func (l *Lexer) step(fn LexFn) LexFn {
+	if l.trace == nil && l.edges == nil && !l.noProgress {
+		return fn(l)
+	}
 
-	l.Pos += w
-	l.Width = w
+	if l.trace != nil {
+		fmt.Fprintf(l.trace, "rplex: %s: state %s\n", l.Position(), l.stateName(fn))
+	}
+	pos := l.Pos
+	next := fn(l)
 
-	l.Prev = l.Cur
-	l.Cur = r
+	if l.trace != nil {
+		switch {
+		case l.Pos > pos:
+			fmt.Fprintf(l.trace, "rplex: %s: accepted %q\n", l.Position(), l.Text[pos:l.Pos])
+		case l.Pos < pos:
+			fmt.Fprintf(l.trace, "rplex: %s: backed up %d bytes\n", l.Position(), pos-l.Pos)
+		}
+	}
 
-	return r
-}
+	if l.edges != nil && next != nil {
+		l.edges[[2]string{l.stateName(fn), l.stateName(next)}]++
+	}
 
-// Backup moves the lexer back one rune
-// can only be used once per call of next()
-func (l *Lexer) Backup() {
-	l.Pos -= l.Width
+	if l.noProgress {
+		l.checkProgress(fn, next, pos)
+	}
+	return next
 }
 
-// Peek returns the next rune in the input
-// without moving the internal pointer
-func (l *Lexer) Peek() rune {
-	r := l.Next()
-	l.Backup()
-	return r
+// checkProgress halts lexing with an ErrorToken and an error
+// wrapping ErrNoProgress if more than the allowed number of
+// LexFns in a row have returned without consuming input
+func (l *Lexer) checkProgress(fn, next LexFn, pos int) {
+	if l.Pos != pos {
+		l.stalls = 0
+		return
+	}
+
+	l.stalls++
+	if next == nil || l.stalls <= l.maxStalls {
+		return
+	}
+
+	name := l.stateName(fn)
+	l.Errorf("no progress in state %s", name)
+	l.err = fmt.Errorf("%w in state %s at byte %d", ErrNoProgress, name, l.Pos)
 }
 
-// Ignore skips the current token
-func (l *Lexer) Ignore() {
-	l.TokenStart = l.Pos
+// funcName returns the name of fn as known to the runtime,
+// without the package path
+func funcName(fn LexFn) string {
+	f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+	if f == nil {
+		return "?"
+	}
+	name := f.Name()
+	return name[strings.LastIndex(name, "/")+1:]
 }
 
-// Emit adds the current token to the token slice and
-// moves the tokenStart pointer to the current position
-func (l *Lexer) Emit(t Token) {
-	t.SetText(l.Text[l.TokenStart:l.Pos])
-	l.TokenStart = l.Pos
+// ErrNoProgress is the error returned by RunSafe, and by Err
+// for lexers created with WithMaxStalls, when a LexFn chain
+// stops consuming input
+var ErrNoProgress = errors.New("rplex: LexFns are not consuming input")
 
-	l.Tokens = append(l.Tokens, t)
+// RunSafe runs the lexer like RunE, but halts with an error
+// wrapping ErrNoProgress if more than maxStalls LexFns in a row
+// return without the current position having moved. An
+// ErrorToken naming the stuck LexFn is emitted when it halts
+func (l *Lexer) RunSafe(initial LexFn, maxStalls int) ([]Token, error) {
+	noProgress, prevMax := l.noProgress, l.maxStalls
+	l.noProgress, l.maxStalls, l.stalls = true, maxStalls, 0
+	defer func() { l.noProgress, l.maxStalls = noProgress, prevMax }()
+
+	return l.RunE(initial)
 }
 
-// Accept moves the pointer if the next rune is in
-// the set of valid runes
-func (l *Lexer) Accept(valid string) bool {
-	if strings.ContainsRune(valid, l.Next()) {
-		return true
+// RunInto runs the lexer, appending the lexed tokens to dst
+// rather than to the Lexer's own token slice, and returns the
+// extended slice. Passing dst[:0] reuses dst's capacity
+func (l *Lexer) RunInto(dst []Token, initial LexFn) []Token {
+	l.Tokens = dst
+	l.unEmit = -1
+	return l.Run(initial)
+}
+
+// NextToken runs the lexer only until it has emitted a token, and
+// returns that token. Lexing carries on from where it stopped on the
+// next call, so initial is only used on the first call. The most
+// recently emitted token is held back until another is emitted, so
+// that it can still be changed by methods like EmitCoalesce and
+// UnEmit. Returned tokens are removed from the token slice. Once
+// lexing has finished and all tokens have been returned, nil is
+// returned
+func (l *Lexer) NextToken(initial LexFn) Token {
+	if !l.started {
+		l.state = initial
+		l.started = true
 	}
-	l.Backup()
-	return false
+
+	for len(l.Tokens) < 2 && l.state != nil && l.err == nil {
+		l.state = l.step(l.state)
+	}
+
+	if l.state == nil || l.err != nil {
+		l.emitEOF()
+	}
+
+	if len(l.Tokens) == 0 {
+		return nil
+	}
+
+	t := l.Tokens[0]
+	l.Tokens = l.Tokens[1:]
+	if len(l.Tokens) == 0 {
+		l.unEmit = -1
+	}
+	return t
 }
 
-// AcceptRun continually accepts runes from the
-// set of valid runes
-func (l *Lexer) AcceptRun(valid string) {
-	for strings.ContainsRune(valid, l.Next()) {
+// All returns an iterator over the tokens returned by NextToken, so
+// that the tokens can be ranged over as they are lexed. Breaking out
+// of the loop stops lexing; a later range carries on where it stopped
+func (l *Lexer) All(initial LexFn) iter.Seq[Token] {
+	return func(yield func(Token) bool) {
+		for t := l.NextToken(initial); t != nil; t = l.NextToken(initial) {
+			if !yield(t) {
+				return
+			}
+		}
 	}
-	l.Backup()
 }
 
-// RuneCheck is a function that determines if a rune is valid
-// or not when using AcceptFunc or AcceptRunFunc. Some functions
-// in the standard library, such as unicode.IsNumber() meet
-// this interface already.
-type RuneCheck func(rune) bool
+// RunChan runs the lexer in a new goroutine and returns a channel
+// that the lexed tokens are sent on as they are returned by NextToken.
+// The channel is closed when lexing has finished, after which Err can
+// be called. The channel must be read until it is closed or the
+// goroutine will never exit
+func (l *Lexer) RunChan(initial LexFn) <-chan Token {
+	ch := make(chan Token)
+	go func() {
+		defer close(ch)
+		for t := l.NextToken(initial); t != nil; t = l.NextToken(initial) {
+			ch <- t
+		}
+	}()
+	return ch
+}
 
-// AcceptFunc accepts a rune if the provided runeCheck
-// function returns true
-func (l *Lexer) AcceptFunc(fn RuneCheck) {
-	if fn(l.Next()) {
+// RunE runs the lexer and returns the lexed tokens along
+// with the error that halted lexing, if there was one
+func (l *Lexer) RunE(initial LexFn) ([]Token, error) {
+	ts := l.Run(initial)
+	return ts, l.err
+}
+
+// ctxCheckInterval is how many calls to Next are made
+// between checks of the context passed to RunContext
+const ctxCheckInterval = 1024
+
+// RunContext runs the lexer until it finishes or the context
+// is done, and returns the lexed tokens along with the error
+// that halted lexing, if there was one. The context is checked
+// between LexFns and periodically within Next
+func (l *Lexer) RunContext(ctx context.Context, initial LexFn) ([]Token, error) {
+	l.ctx = ctx
+	defer func() { l.ctx = nil }()
+
+	for lexfn := initial; lexfn != nil && l.err == nil; {
+		if err := ctx.Err(); err != nil {
+			l.err = err
+			break
+		}
+		lexfn = l.step(lexfn)
+	}
+	l.emitEOF()
+	return l.Tokens, l.err
+}
+
+// emitEOF emits the EOF token if the Lexer was created
+// with WithEOFToken and it hasn't been emitted already
+func (l *Lexer) emitEOF() {
+	if l.eof == nil || l.eofEmitted {
 		return
 	}
-	l.Backup()
+	l.eofEmitted = true
+
+	t := l.eof()
+	t.SetText("")
+	l.setPos(t, len(l.Text), len(l.Text))
+	l.setLineCol(t, len(l.Text))
+	l.Tokens = append(l.Tokens, t)
+	l.unEmit = -1
 }
 
-// AcceptRunFunc continually accepts runes for as long
-// as the runeCheck function returns true
-func (l *Lexer) AcceptRunFunc(fn RuneCheck) {
-	for fn(l.Next()) {
+// setPos sets the position of t if it's a PosToken, adjusting
+// start and end by the Lexer's Offset
+func (l *Lexer) setPos(t Token, start, end int) {
+	if pt, ok := t.(PosToken); ok {
+		pt.SetPos(start+l.Offset, end+l.Offset)
 	}
-	l.Backup()
 }
 
-// AcceptUntil accepts runes until it hits a delimiter
-// rune contained in the provided string
-func (l *Lexer) AcceptUntil(delims string) {
-	for !strings.ContainsRune(delims, l.Next()) {
-		if l.Cur == utf8.RuneError {
-			return
-		}
+// lineCol is a line and column number at a position in the input
+type lineCol struct {
+	pos, line, col int
+}
+
+// setLineCol sets the line and column of t to those
+// at pos if it's a LineColToken
+func (l *Lexer) setLineCol(t Token, pos int) {
+	if lt, ok := t.(LineColToken); ok {
+		lt.SetLineCol(l.lineColAt(pos))
 	}
-	l.Backup()
 }
 
-// AcceptUntilUnescaped accepts runes until it hits a delimiter
-// rune contained in the provided string, unless that rune was
-// escaped with a backslash
-func (l *Lexer) AcceptUntilUnescaped(delims string) {
+// lineColAt returns the line and column at pos, counting from the
+// last position they were found at if it's before pos, or from the
+// start of Text otherwise
+func (l *Lexer) lineColAt(pos int) (int, int) {
+	if l.lc.line == 0 || pos < l.lc.pos {
+		// A skipped byte order mark isn't counted
+		l.lc = lineCol{min(l.bom.size(), pos), 1, 1}
+		if l.base.line > 0 {
+			l.lc = l.base
+		}
+	}
 
-	// Read until we hit an unescaped rune or the end of the input
-	inEscape := false
-	for {
-		r := l.Next()
-		if r == '\\' && !inEscape {
-			inEscape = true
+	for _, r := range l.Text[l.lc.pos:pos] {
+		if r == '\n' {
+			l.lc.line++
+			l.lc.col = 1
 			continue
 		}
-		if strings.ContainsRune(delims, r) && !inEscape {
-			l.Backup()
-			return
+		l.lc.col++
+	}
+	l.lc.pos = pos
+
+	return l.lc.line, l.lc.col
+}
+
+// SubLexer returns a new Lexer, with the same options, OnEmit hooks
+// and LexFn names, for the input text between start and end. The
+// positions of any PosTokens it emits are relative to the parent's
+// input
+func (l *Lexer) SubLexer(start, end int) *Lexer {
+	c := New(l.Text[start:end], l.opts...)
+	c.Offset = start + l.Offset
+	c.eof = nil
+	c.hooks = l.hooks[:len(l.hooks):len(l.hooks)]
+	c.names = l.names
+	return c
+}
+
+// Err returns the error that halted lexing, or nil if
+// there wasn't one
+func (l *Lexer) Err() error {
+	return l.err
+}
+
+// RunParallel splits the input into chunks with the split
+// function and runs the lexer over each chunk concurrently
+// using the specified number of workers. Each chunk is lexed
+// by its own Lexer, so the split function must only split
+// the input where a LexFn chain can safely start again. The
+// chunks must be parts of the string given to split, in
+// order, like those from strings.SplitAfter; lexing halts
+// with an error before anything is lexed if they aren't. The
+// tokens from all chunks are returned in input order, with
+// the lines and columns of LineColTokens counted from the
+// start of the input. If lexing a chunk halts with an error
+// the tokens from later chunks are dropped, so that the
+// tokens and Err are the same as if the input was lexed in
+// one go, and the diagnostics from each chunk are merged in
+// input order. Limits set with WithMaxInputLen and WithMaxTokens
+// apply to the whole input rather than to each chunk
+func (l *Lexer) RunParallel(split func(string) []string, initial LexFn, workers int) []Token {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	l.fillAll()
+	l.checkLimits()
+	if l.err != nil {
+		l.emitEOF()
+		return l.Tokens
+	}
+	chunks := split(l.Text)
+
+	// Chunks are found in the input so that the positions, lines
+	// and columns of the tokens lexed from them can be corrected.
+	// Searching for their text could find the wrong copy of it,
+	// so where their memory is in the input's is used instead
+	offsets := make([]int, len(chunks))
+	starts := make([]lineCol, len(chunks))
+	base := uintptr(unsafe.Pointer(unsafe.StringData(l.Text)))
+	cursor := 0
+	for i, chunk := range chunks {
+		offsets[i] = cursor
+		if chunk != "" {
+			offsets[i] = int(uintptr(unsafe.Pointer(unsafe.StringData(chunk))) - base)
 		}
-		if l.Cur == utf8.RuneError {
-			return
+		if offsets[i] < cursor || offsets[i] > len(l.Text)-len(chunk) {
+			l.err = fmt.Errorf("rplex: chunk %d from the split function isn't part of the input, in order", i)
+			l.emitEOF()
+			return l.Tokens
 		}
-		inEscape = false
+		cursor = offsets[i] + len(chunk)
+
+		line, col := l.lineColAt(offsets[i])
+		starts[i] = lineCol{0, line, col}
+	}
+	subs := make([]*Lexer, len(chunks))
+
+	var traces []strings.Builder
+	if l.trace != nil {
+		traces = make([]strings.Builder, len(chunks))
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				c := l.SubLexer(offsets[i], offsets[i]+len(chunks[i]))
+				c.Line, c.Column = starts[i].line, starts[i].col
+				c.base = starts[i]
+				c.snapshotLineCol()
+				c.maxTokens = 0
+				if traces != nil {
+					c.trace = &traces[i]
+				}
+				c.Run(initial)
+				subs[i] = c
+			}
+		}()
+	}
+
+	for i := range chunks {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, c := range subs {
+		if traces != nil {
+			io.WriteString(l.trace, traces[i].String())
+		}
+
+		if over := l.emitted + len(c.Tokens) - l.maxTokens; l.maxTokens > 0 && over > 0 {
+			kept := len(c.Tokens) - over
+			l.Tokens = append(l.Tokens, c.Tokens[:kept]...)
+			l.emitted += kept
+
+			// The ErrorToken goes where the first token over
+			// the limit ended, as it would when lexing in one go
+			if pt, ok := c.Tokens[kept].(PosToken); ok {
+				_, end := pt.Pos()
+				l.Pos, l.TokenStart = end-l.Offset, end-l.Offset
+			}
+			l.exceeded("token count", l.maxTokens)
+			break
+		}
+
+		l.Tokens = append(l.Tokens, c.Tokens...)
+		l.emitted += len(c.Tokens)
+		l.diags = append(l.diags, c.diags...)
+		if err := c.err; err != nil {
+			if l.err == nil {
+				l.err = err
+			}
+			break
+		}
+	}
+	l.unEmit = -1
+	l.emitEOF()
+	return l.Tokens
+}
+
+// EOF is returned by Next when the end of the input has been
+// reached or lexing has halted. Unlike utf8.RuneError it can't
+// be confused with an invalid byte in the input
+const EOF rune = -1
+
+// Next gets the next rune in the input and updates the lexer
+// state. It returns EOF if there is no next rune
+func (l *Lexer) Next() rune {
+	if l.ctx != nil {
+		l.ticks++
+		if l.ticks >= ctxCheckInterval {
+			l.ticks = 0
+			if err := l.ctx.Err(); err != nil && l.err == nil {
+				l.err = err
+			}
+		}
+	}
+
+	if len(l.Text)-l.Pos < utf8.UTFMax {
+		l.fill(utf8.UTFMax)
+
+		// A read error only halts lexing once the
+		// input read before it has been used up
+		if l.Pos == len(l.Text) && l.readErr != nil && l.readErr != io.EOF && l.err == nil {
+			l.err = l.readErr
+		}
+	}
+
+	if l.limited {
+		l.checkLimits()
+	}
+	if l.err != nil {
+		l.Width = 0
+		return EOF
+	}
+
+	r, w := l.decodeRune(l.Text[l.Pos:])
+	if w == 0 {
+		r = EOF
+	}
+
+	if r == utf8.RuneError && w == 1 {
+		switch l.invalid {
+		case InvalidSkip:
+			skipped := 0
+			for r == utf8.RuneError && w == 1 {
+				skipped++
+				l.fill(skipped + utf8.UTFMax)
+				r, w = l.decodeRune(l.Text[l.Pos+skipped:])
+			}
+			if w == 0 {
+				// Only invalid bytes were left, so they're
+				// consumed and the end of the input is reached
+				l.Pos += skipped
+				r = EOF
+				break
+			}
+			w += skipped
+		case InvalidError:
+			l.err = fmt.Errorf("rplex: invalid UTF-8 at byte %d", l.Pos+l.Offset)
+			l.Width = 0
+			return EOF
+		case InvalidReport:
+			// Peek and rewinds read the same bytes again,
+			// so each one must only be reported once
+			if l.Pos >= l.invalidSeen {
+				l.invalidSeen = l.Pos + 1
+				l.Diag(SeverityError, "invalid UTF-8 byte %#x", l.Text[l.Pos])
+			}
+		}
+	}
+
+	l.Pos += w
+	l.Width = w
+
+	l.Prev = l.Cur
+	l.Cur = r
+
+	if w > 0 {
+		if l.hist.ring != nil {
+			l.hist.push(r, w)
+		}
+		if r == '\n' {
+			l.Line++
+			l.Column = 1
+		} else {
+			l.Column++
+		}
+	}
+
+	return r
+}
+
+// decodeRune decodes the first rune in s using the
+// decoder from WithRuneDecoder if there is one
+func (l *Lexer) decodeRune(s string) (rune, int) {
+	if l.decode == nil {
+		return utf8.DecodeRuneInString(s)
+	}
+	return l.decode(s)
+}
+
+// Backup moves the lexer back one rune
+// can only be used once per call of next()
+func (l *Lexer) Backup() {
+	l.Pos -= l.Width
+	if l.Width == 0 {
+		return
+	}
+	if l.hist.ring != nil {
+		l.hist.pop()
+	}
+
+	if l.Cur == '\n' {
+		l.Line--
+		l.Column = l.columnAt(l.Pos)
+		return
+	}
+	l.Column--
+}
+
+// BackupN moves the lexer back n runes. The runes must have been
+// read with Next. They're normally decoded again from the input, so
+// BackupN can move back as far as the input goes, but lexers created
+// with WithRuneDecoder or InvalidSkip only remember the most recent
+// runes. BackupN returns false and does nothing if n is too large
+func (l *Lexer) BackupN(n int) bool {
+	if n < 0 {
+		return false
+	}
+	if l.hist.ring != nil {
+		return l.backupHistory(n)
+	}
+
+	floor := l.backupFloor()
+	pos := l.Pos
+	for i := 0; i < n; i++ {
+		if pos <= floor {
+			return false
+		}
+		_, w := utf8.DecodeLastRuneInString(l.Text[:pos])
+		pos -= w
+	}
+
+	lines := strings.Count(l.Text[pos:l.Pos], "\n")
+	l.Pos = pos
+	l.Column -= n
+	if lines > 0 {
+		l.Line -= lines
+		l.Column = l.columnAt(l.Pos)
+	}
+
+	l.Width, l.Cur, l.Prev = 0, utf8.RuneError, utf8.RuneError
+	if pos > floor {
+		l.Cur, l.Width = utf8.DecodeLastRuneInString(l.Text[floor:pos])
+	}
+	if pos-l.Width > floor {
+		l.Prev, _ = utf8.DecodeLastRuneInString(l.Text[floor : pos-l.Width])
+	}
+	return true
+}
+
+// backupFloor returns the earliest position BackupN can move back
+// to, which is after the byte order mark if one was skipped
+func (l *Lexer) backupFloor() int {
+	if l.discarded > 0 {
+		return 0
+	}
+	return l.bom.size()
+}
+
+// backupHistory is BackupN for lexers that
+// remember the widths of the runes they read
+func (l *Lexer) backupHistory(n int) bool {
+	if n > l.hist.len || l.hist.bytes(n) > l.Pos {
+		return false
+	}
+
+	lines := 0
+	for i := 0; i < n; i++ {
+		rw := l.hist.pop()
+		l.Pos -= rw.w
+		if rw.r == '\n' {
+			lines++
+		}
+		l.Column--
+	}
+
+	if lines > 0 {
+		l.Line -= lines
+		l.Column = l.columnAt(l.Pos)
+	}
+
+	l.Width, l.Cur, l.Prev = 0, utf8.RuneError, utf8.RuneError
+	if l.hist.len > 0 {
+		l.Width, l.Cur = l.hist.at(0).w, l.hist.at(0).r
+	}
+	if l.hist.len > 1 {
+		l.Prev = l.hist.at(1).r
+	}
+	return true
+}
+
+// historySize is how many runes are remembered by lexers that
+// can't find the widths of runes by decoding them again, unless
+// WithLookahead asks for more
+const historySize = 32
+
+// runeWidth is a rune and its width in the input in bytes
+type runeWidth struct {
+	r rune
+	w int
+}
+
+// history is a ring buffer of the most recently read runes.
+// Its length is a power of two so that positions in it can
+// be found with a mask, and next only wraps when it overflows
+type history struct {
+	ring []runeWidth
+	next int
+	len  int
+}
+
+// reset empties the history and makes room for at least n
+// runes in it, reusing ring if it's big enough
+func (h *history) reset(ring []runeWidth, n int) {
+	size := 1
+	for size < n {
+		size *= 2
+	}
+	if cap(ring) < size {
+		ring = make([]runeWidth, size)
+	}
+	*h = history{ring: ring[:size]}
+}
+
+// clear forgets all of the runes in the history
+func (h *history) clear() {
+	h.len = 0
+}
+
+// clone returns a copy of the history that
+// doesn't share its ring buffer
+func (h *history) clone() history {
+	c := *h
+	if h.ring != nil {
+		c.ring = append([]runeWidth(nil), h.ring...)
+	}
+	return c
+}
+
+// restore makes the history the same as c, which
+// must be a clone of a history with the same size
+func (h *history) restore(c history) {
+	copy(h.ring, c.ring)
+	h.next, h.len = c.next, c.len
+}
+
+// push adds a rune to the history, forgetting
+// the oldest rune if the history is full
+func (h *history) push(r rune, w int) {
+	h.ring[h.next&(len(h.ring)-1)] = runeWidth{r, w}
+	h.next++
+	if h.len < len(h.ring) {
+		h.len++
+	}
+}
+
+// pop removes the most recent rune from the history and returns it
+func (h *history) pop() runeWidth {
+	if h.len == 0 {
+		return runeWidth{}
+	}
+	h.next--
+	h.len--
+	return h.ring[h.next&(len(h.ring)-1)]
+}
+
+// at returns the rune i places back from the most recent
+func (h *history) at(i int) runeWidth {
+	return h.ring[(h.next-1-i)&(len(h.ring)-1)]
+}
+
+// bytes returns the total width of the n most recent runes
+func (h *history) bytes(n int) int {
+	total := 0
+	for i := 0; i < n; i++ {
+		total += h.at(i).w
+	}
+	return total
+}
+
+// columnAt returns the column of the byte offset pos
+func (l *Lexer) columnAt(pos int) int {
+	lineStart := strings.LastIndexByte(l.Text[:pos], '\n') + 1
+	if lineStart+l.discarded == 0 {
+		// A skipped byte order mark isn't counted
+		lineStart = min(l.bom.size(), pos)
+	}
+	col := utf8.RuneCountInString(l.Text[lineStart:pos]) + 1
+
+	// The start of the line may have been discarded
+	if lineStart == 0 && l.base.line > 0 {
+		col += l.base.col - 1
+	}
+	return col
+}
+
+// A Position is a location in the input
+type Position struct {
+	Offset int // The byte offset, from 0
+	Line   int // The line number, from 1
+	Column int // The column in runes, from 1
+}
+
+// String returns the position formatted as line:column
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// Position returns the current position in the input
+func (l *Lexer) Position() Position {
+	return Position{
+		Offset: l.Pos,
+		Line:   l.Line,
+		Column: l.Column,
+	}
+}
+
+// Peek returns the next rune in the input
+// without moving the internal pointer
+func (l *Lexer) Peek() rune {
+	r := l.Next()
+	l.Backup()
+	return r
+}
+
+// AtEOF returns true if there is no more input to lex,
+// either because it has all been read or lexing has halted
+func (l *Lexer) AtEOF() bool {
+	return l.Peek() == EOF
+}
+
+// PeekN returns up to the next n runes in the input without
+// moving the internal pointer. Fewer than n runes are returned
+// if the end of the input is reached first, and nil is
+// returned if n isn't positive
+func (l *Lexer) PeekN(n int) []rune {
+	if n <= 0 {
+		return nil
+	}
+	l.fill(n * utf8.UTFMax)
+
+	runes := make([]rune, 0, n)
+	for pos := l.Pos; len(runes) < n && pos < len(l.Text); {
+		r, w := l.decodeRune(l.Text[pos:])
+		pos += w
+
+		if r == utf8.RuneError && w == 1 {
+			if l.invalid == InvalidSkip {
+				continue
+			}
+			if l.invalid == InvalidError {
+				break
+			}
+		}
+		runes = append(runes, r)
+	}
+	return runes
+}
+
+// PeekOK returns the next rune in the input without moving
+// the internal pointer. Unlike Peek it also returns false if
+// there is no next rune because the end of the input has been
+// reached
+func (l *Lexer) PeekOK() (rune, bool) {
+	r := l.Next()
+	ok := l.Width > 0
+	l.Backup()
+	return r, ok
+}
+
+// Ignore skips the current token
+func (l *Lexer) Ignore() {
+	l.TokenStart = l.Pos
+	l.snapshotLineCol()
+}
+
+// snapshotLineCol records the current line and column so
+// that they can be given to LineColTokens starting here
+func (l *Lexer) snapshotLineCol() {
+	l.lc = lineCol{l.Pos, l.Line, l.Column}
+}
+
+// AttachLeadingTrivia skips the current token like Ignore, but
+// keeps its text so that the next emitted token can hold it as
+// leading trivia if it's a TriviaToken
+func (l *Lexer) AttachLeadingTrivia() {
+	l.trivia += l.Text[l.TokenStart:l.Pos]
+	l.Ignore()
+}
+
+// Emit adds the current token to the token slice and
+// moves the tokenStart pointer to the current position.
+// If the token is a PosToken its position is set too.
+// The token's text shares memory with Text rather than
+// being a copy, so it costs nothing to set, but a token
+// that is kept also keeps the whole input in memory
+func (l *Lexer) Emit(t Token) {
+	l.emitText(t, l.Pending())
+}
+
+// EmitText emits the current token like Emit, but with the
+// provided text instead of the text from the input; e.g. a
+// string with its escape sequences replaced. A PosToken still
+// gets the position of the text in the input
+func (l *Lexer) EmitText(t Token, text string) {
+	l.emitText(t, text)
+}
+
+// EmitKind sets the kind of t and then emits the current token
+func (l *Lexer) EmitKind(t KindToken, k Kind) {
+	t.SetKind(k)
+	l.Emit(t)
+}
+
+// EmitNonEmpty emits the current token like Emit, but only if
+// its text isn't empty. It returns true if the token was emitted
+func (l *Lexer) EmitNonEmpty(t Token) bool {
+	if l.Pos == l.TokenStart {
+		return false
+	}
+	l.Emit(t)
+	return true
+}
+
+// emitText emits the current token with the provided text
+func (l *Lexer) emitText(t Token, text string) {
+	// A token that's too long is never emitted, even
+	// if lexing was halted by something else first
+	if l.maxTokenLen > 0 && l.Pos-l.TokenStart > l.maxTokenLen {
+		if l.err == nil {
+			l.exceeded("token length", l.maxTokenLen)
+		}
+		return
+	}
+
+	start := l.TokenStart
+	if l.invalid == InvalidToken {
+		if i := l.invalidIndex(start, l.Pos); i >= 0 {
+			t = &ErrorToken{Msg: fmt.Sprintf("invalid UTF-8 byte %#x", l.Text[i])}
+			text = l.Text[start:l.Pos]
+		}
+	}
+
+	t.SetText(text)
+	l.setPos(t, start, l.Pos)
+	l.setLineCol(t, start)
+	l.TokenStart = l.Pos
+	l.snapshotLineCol()
+
+	if tt, ok := t.(TriviaToken); ok {
+		tt.SetLeadingTrivia(l.trivia)
+	}
+	l.trivia = ""
+
+	l.push(t, start, start)
+}
+
+// invalidIndex returns the position of the first invalid
+// byte between start and end, or -1 if there isn't one
+func (l *Lexer) invalidIndex(start, end int) int {
+	for pos := start; pos < end; {
+		r, w := l.decodeRune(l.Text[pos:end])
+		if r == utf8.RuneError && w == 1 {
+			return pos
+		}
+		pos += max(w, 1)
+	}
+	return -1
+}
+
+// push passes t through the hooks registered with OnEmit and
+// adds the result to the token slice, unless a hook dropped it
+// or the Lexer was created with WithDedupeConsecutive and it is
+// equal to the last token. The token starts at start, and UnEmit
+// moves the token start back to undo if the token is added
+func (l *Lexer) push(t Token, start, undo int) {
+	if l.trace != nil {
+		fmt.Fprintf(l.trace, "rplex: emit %T %q at byte %d\n", t, t.Text(), start+l.Offset)
+	}
+
+	for _, hook := range l.hooks {
+		if t = hook(t); t == nil {
+			l.unEmit = -1
+			return
+		}
+	}
+
+	if l.dedupe != nil && len(l.Tokens) > 0 && l.dedupe(l.Tokens[len(l.Tokens)-1], t) {
+		l.unEmit = -1
+		return
+	}
+
+	if l.maxTokens > 0 && l.emitted >= l.maxTokens {
+		if l.err == nil {
+			l.exceeded("token count", l.maxTokens)
+		}
+		return
+	}
+	l.emitted++
+	l.Tokens = append(l.Tokens, t)
+	l.prevStart, l.lastStart = l.lastStart, start
+	l.unEmit = undo
+}
+
+// OnEmit registers a hook that is called with each token as it's
+// emitted. The hook returns the token to add to the token slice,
+// which can be a different token, or nil to drop it. Hooks are
+// called in the order they were registered. They're shared with
+// lexers from SubLexer, so with RunParallel they're called from
+// several goroutines at once
+func (l *Lexer) OnEmit(hook func(Token) Token) {
+	l.hooks = append(l.hooks, hook)
+}
+
+// EmitAndDispatch emits the current token and returns the LexFn
+// keyed by the token's text in the table, or def if there isn't one
+func (l *Lexer) EmitAndDispatch(t Token, table map[string]LexFn, def LexFn) LexFn {
+	l.Emit(t)
+	if fn, ok := table[t.Text()]; ok {
+		return fn
+	}
+	return def
+}
+
+// AppendToBuffer adds a rune to the Lexer's buffer, which
+// can be used to build token text that differs from the input
+func (l *Lexer) AppendToBuffer(r rune) {
+	l.buf.WriteRune(r)
+}
+
+// BufferString returns the contents of the Lexer's buffer
+func (l *Lexer) BufferString() string {
+	return l.buf.String()
+}
+
+// EmitBuffered emits the current token like Emit, but with the
+// contents of the Lexer's buffer as its text. The buffer is cleared
+func (l *Lexer) EmitBuffered(t Token) {
+	l.emitText(t, l.buf.String())
+	l.buf.Reset()
+}
+
+// EmitPooled emits the current token using a token from the
+// pool provided with WithTokenPool, and returns the token
+func (l *Lexer) EmitPooled() Token {
+	return l.EmitFrom(l.pool)
+}
+
+// EmitFrom emits the current token using a token from the pool,
+// whose New function must return a Token, and returns the token.
+// It's like EmitPooled but lets each kind of token have its own
+// pool. The token should be put back into the pool once it's no
+// longer needed
+func (l *Lexer) EmitFrom(pool *sync.Pool) Token {
+	t := pool.Get().(Token)
+	l.Emit(t)
+	return t
+}
+
+// ReleaseTokens puts tokens back into the pool provided with
+// WithTokenPool so that EmitPooled can reuse them. The tokens
+// must not be used after they are released, so ts is cleared
+func (l *Lexer) ReleaseTokens(ts []Token) {
+	for i, t := range ts {
+		t.SetText("")
+		l.pool.Put(t)
+		ts[i] = nil
+	}
+}
+
+// EmitRange adds a token with the text between start and end to
+// the token slice without moving the tokenStart pointer or the
+// current position. It returns false and emits nothing if the
+// range is not within the input
+func (l *Lexer) EmitRange(t Token, start, end int) bool {
+	if start < 0 || start > end || end > len(l.Text) {
+		return false
+	}
+
+	t.SetText(l.Text[start:end])
+	l.setPos(t, start, end)
+	l.setLineCol(t, start)
+
+	l.push(t, start, l.TokenStart)
+	return true
+}
+
+// EmitCoalesce emits the current token, unless the last emitted
+// token has the same concrete type as t, and the same Kind if
+// they're KindTokens; in which case the last token's text is
+// extended up to the current position instead
+func (l *Lexer) EmitCoalesce(t Token) {
+	last := l.LastToken()
+	if last == nil || reflect.TypeOf(last) != reflect.TypeOf(t) {
+		l.Emit(t)
+		return
+	}
+
+	if lk, ok := last.(KindToken); ok && lk.Kind() != t.(KindToken).Kind() {
+		l.Emit(t)
+		return
+	}
+
+	last.SetText(l.Text[l.lastStart:l.Pos])
+	l.setPos(last, l.lastStart, l.Pos)
+	l.unEmit = l.lastStart
+	l.TokenStart = l.Pos
+}
+
+// UnEmit removes the last emitted token from the token slice and
+// returns it, moving the tokenStart pointer back to where it was
+// before the token was emitted. The current position is unchanged,
+// so the token's text becomes part of the current token again.
+// Only the most recent Emit can be undone; false is returned if
+// there is nothing to undo
+func (l *Lexer) UnEmit() (Token, bool) {
+	if l.unEmit < 0 || len(l.Tokens) == 0 {
+		return nil, false
+	}
+
+	t := l.Tokens[len(l.Tokens)-1]
+	l.Tokens = l.Tokens[:len(l.Tokens)-1]
+	l.TokenStart = l.unEmit
+	l.lastStart = l.prevStart
+	l.unEmit = -1
+	l.emitted--
+	return t, true
+}
+
+// LastToken returns the most recently emitted token,
+// or nil if no tokens have been emitted
+func (l *Lexer) LastToken() Token {
+	if len(l.Tokens) == 0 {
+		return nil
+	}
+	return l.Tokens[len(l.Tokens)-1]
+}
+
+// LastTokenText returns the text of the most recently emitted
+// token, or an empty string if no tokens have been emitted
+func (l *Lexer) LastTokenText() string {
+	if len(l.Tokens) == 0 {
+		return ""
+	}
+	return l.Tokens[len(l.Tokens)-1].Text()
+}
+
+// Accept moves the pointer if the next rune is in
+// the set of valid runes
+func (l *Lexer) Accept(valid string) bool {
+	if strings.ContainsRune(valid, l.Next()) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRun continually accepts runes from the set of
+// valid runes and returns how many runes were accepted
+func (l *Lexer) AcceptRun(valid string) int {
+	n := 0
+	for strings.ContainsRune(valid, l.Next()) {
+		n++
+	}
+	l.Backup()
+	return n
+}
+
+// AcceptBetween moves the pointer if the next rune
+// is between lo and hi inclusive
+func (l *Lexer) AcceptBetween(lo, hi rune) bool {
+	r := l.Next()
+	if l.Width > 0 && lo <= r && r <= hi {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRunBetween continually accepts runes that are between
+// lo and hi inclusive and returns how many runes were accepted
+func (l *Lexer) AcceptRunBetween(lo, hi rune) int {
+	n := 0
+	for l.AcceptBetween(lo, hi) {
+		n++
+	}
+	return n
+}
+
+// AcceptExcept moves the pointer if the next rune is not
+// in the set of invalid runes. The end of the input is
+// never accepted
+func (l *Lexer) AcceptExcept(invalid string) bool {
+	r := l.Next()
+	if l.Width > 0 && !strings.ContainsRune(invalid, r) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRunExcept continually accepts runes that are not in the
+// set of invalid runes and returns how many runes were accepted
+func (l *Lexer) AcceptRunExcept(invalid string) int {
+	n := 0
+	for l.AcceptExcept(invalid) {
+		n++
+	}
+	return n
+}
+
+// AcceptRunStoppingAt continually accepts runes from the set
+// of valid runes, but stops at any rune in the set of stop
+// runes even if it's also in the set of valid runes. It
+// returns how many runes were accepted
+func (l *Lexer) AcceptRunStoppingAt(valid string, stops string) int {
+	for n := 0; ; n++ {
+		r := l.Next()
+		if strings.ContainsRune(stops, r) || !strings.ContainsRune(valid, r) {
+			l.Backup()
+			return n
+		}
+	}
+}
+
+// AcceptWhile continually accepts runes from the set of
+// valid runes and returns how many runes were accepted
+func (l *Lexer) AcceptWhile(valid string) int {
+	n := 0
+	for l.Accept(valid) {
+		n++
+	}
+	return n
+}
+
+// AcceptWhileFunc continually accepts runes for as long as the
+// runeCheck function returns true and returns how many runes
+// were accepted
+func (l *Lexer) AcceptWhileFunc(fn RuneCheck) int {
+	n := 0
+	for {
+		if _, ok := l.AcceptIf(fn); !ok {
+			return n
+		}
+		n++
+	}
+}
+
+// RuneCheck is a function that determines if a rune is valid
+// or not when using AcceptFunc or AcceptRunFunc. Some functions
+// in the standard library, such as unicode.IsNumber() meet
+// this interface already.
+type RuneCheck func(rune) bool
+
+// AcceptFunc accepts a rune if the provided runeCheck
+// function returns true
+func (l *Lexer) AcceptFunc(fn RuneCheck) {
+	if fn(l.Next()) {
+		return
+	}
+	l.Backup()
+}
+
+// AcceptIf accepts the next rune and returns it if the provided
+// runeCheck function returns true. Otherwise nothing is accepted
+// and utf8.RuneError is returned
+func (l *Lexer) AcceptIf(fn RuneCheck) (rune, bool) {
+	r := l.Next()
+	if l.Width > 0 && fn(r) {
+		return r, true
+	}
+	l.Backup()
+	return utf8.RuneError, false
+}
+
+// AcceptRunFunc continually accepts runes for as long as the
+// runeCheck function returns true and returns how many runes
+// were accepted. It stops at the end of the input even if the
+// runeCheck function returns true for EOF
+func (l *Lexer) AcceptRunFunc(fn RuneCheck) int {
+	n := 0
+	for fn(l.Next()) && l.Width > 0 {
+		n++
+	}
+	l.Backup()
+	return n
+}
+
+// AcceptIdentifier accepts a letter or underscore followed by any
+// number of letters, digits or underscores and returns true if
+// anything was accepted
+func (l *Lexer) AcceptIdentifier() bool {
+	return l.AcceptIdentifierFunc(IsIdentContinue)
+}
+
+// AcceptIdentifierFunc is like AcceptIdentifier but uses the
+// provided runeCheck function to decide which runes may follow
+// the first one; e.g. to allow hyphens in CSS-style identifiers
+func (l *Lexer) AcceptIdentifierFunc(cont RuneCheck) bool {
+	if _, ok := l.AcceptIf(IsIdentStart); !ok {
+		return false
+	}
+	l.AcceptWhileFunc(cont)
+	return true
+}
+
+// AcceptUntil accepts runes until it hits a delimiter
+// rune contained in the provided string. It returns false
+// if the end of the input was reached without finding one
+func (l *Lexer) AcceptUntil(delims string) bool {
+	for !strings.ContainsRune(delims, l.Next()) {
+		if l.Width == 0 {
+			return false
+		}
+	}
+	l.Backup()
+	return true
+}
+
+// AcceptUntilString accepts runes until the input at the current
+// position starts with delim. It returns false if the end of the
+// input was reached without finding delim
+func (l *Lexer) AcceptUntilString(delim string) bool {
+	for {
+		l.fill(len(delim))
+		if strings.HasPrefix(l.Text[l.Pos:], delim) {
+			return true
+		}
+		if l.Next(); l.Width == 0 {
+			return false
+		}
+	}
+}
+
+// AcceptUntilUnescaped accepts runes until it hits a delimiter
+// rune contained in the provided string, unless that rune was
+// escaped with a backslash, or the rune set with WithEscapeRune.
+// It returns false if the end of the input was reached without
+// finding one
+func (l *Lexer) AcceptUntilUnescaped(delims string) bool {
+	escape := l.escapeRune()
+
+	// Read until we hit an unescaped rune or the end of the input
+	inEscape := false
+	for {
+		r := l.Next()
+		if r == escape && !inEscape {
+			inEscape = true
+			continue
+		}
+		if strings.ContainsRune(delims, r) && !inEscape {
+			l.Backup()
+			return true
+		}
+		if l.Width == 0 {
+			return false
+		}
+		inEscape = false
+	}
+}
+
+// escapeRune returns the escape rune set
+// with WithEscapeRune, or a backslash
+func (l *Lexer) escapeRune() rune {
+	if l.escape == 0 {
+		return '\\'
+	}
+	return l.escape
+}
+
+// AcceptArgument accepts runes until it hits a rune contained
+// in stopDelims or an unmatched close rune. Runes between nested
+// open and close runes are always accepted, so an argument like
+// g(b, c) is not split on its inner comma. The accepted text and
+// the terminating rune are returned; the terminating rune is not
+// consumed
+func (l *Lexer) AcceptArgument(stopDelims string, open, close rune) (string, rune) {
+	start := l.Pos
+	depth := 0
+	for {
+		r := l.Next()
+		if l.Width == 0 {
+			return l.Text[start:l.Pos], r
+		}
+
+		switch {
+		case r == open:
+			depth++
+		case r == close && depth > 0:
+			depth--
+		case depth == 0 && (r == close || strings.ContainsRune(stopDelims, r)):
+			l.Backup()
+			return l.Text[start:l.Pos], r
+		}
+	}
+}
+
+// SkipSpaces accepts a run of whitespace and ignores it, or
+// emits it if the Lexer was created with WithWhitespaceTokens
+func (l *Lexer) SkipSpaces() {
+	l.AcceptRunFunc(unicode.IsSpace)
+
+	if l.whitespace == nil || l.Pos == l.TokenStart {
+		l.Ignore()
+		return
+	}
+	l.Emit(l.whitespace())
+}
+
+// SkipWhitespace accepts a run of whitespace and ignores it. Unlike
+// SkipSpaces it never emits whitespace tokens
+func (l *Lexer) SkipWhitespace() int {
+	return l.IgnoreRunFunc(unicode.IsSpace)
+}
+
+// IgnoreRun accepts a run of runes from the valid string, ignores
+// the current token and returns how many runes were accepted
+func (l *Lexer) IgnoreRun(valid string) int {
+	n := l.AcceptWhile(valid)
+	l.Ignore()
+	return n
+}
+
+// IgnoreRunFunc accepts runes for as long as the runeCheck function
+// returns true, ignores the current token and returns how many runes
+// were accepted
+func (l *Lexer) IgnoreRunFunc(fn RuneCheck) int {
+	n := l.AcceptWhileFunc(fn)
+	l.Ignore()
+	return n
+}
+
+// Context returns the input text between start and end with up
+// to radius extra bytes either side, clamped to the bounds of
+// the input. It's useful for showing where in the input an
+// error occurred
+func (l *Lexer) Context(start, end, radius int) string {
+	start -= radius
+	if start < 0 {
+		start = 0
+	}
+
+	end += radius
+	if end > len(l.Text) {
+		end = len(l.Text)
+	}
+
+	if start > end {
+		return ""
+	}
+	return l.Text[start:end]
+}
+
+// AcceptLine accepts runes up to but not including the
+// next newline, or to the end of the input
+func (l *Lexer) AcceptLine() {
+	l.AcceptUntil("\n")
+}
+
+// AcceptLineInclusive accepts runes up to and including
+// the next newline, or to the end of the input
+func (l *Lexer) AcceptLineInclusive() {
+	l.AcceptLine()
+	l.Accept("\n")
+}
+
+// SkipLine accepts the rest of the current line and
+// ignores it. The newline itself is not skipped
+func (l *Lexer) SkipLine() {
+	l.AcceptLine()
+	l.Ignore()
+}
+
+// RuneScanner returns an io.RuneScanner that reads runes
+// from the Lexer's input using Next and Backup
+func (l *Lexer) RuneScanner() io.RuneScanner {
+	return &runeScanner{l: l}
+}
+
+type runeScanner struct {
+	l      *Lexer
+	unread bool
+}
+
+func (s *runeScanner) ReadRune() (rune, int, error) {
+	r := s.l.Next()
+	if s.l.Width == 0 {
+		s.unread = false
+		return 0, 0, io.EOF
+	}
+	s.unread = true
+	return r, s.l.Width, nil
+}
+
+func (s *runeScanner) UnreadRune() error {
+	if !s.unread {
+		return errors.New("rplex: UnreadRune must follow a successful ReadRune")
+	}
+	s.unread = false
+	s.l.Backup()
+	return nil
+}
+
+// AcceptQuoted accepts a quoted literal: the open rune, then runes up
+// to and including the close rune. A rune following the escape rune
+// never closes the literal. If the next rune is not the open rune
+// nothing is accepted and false is returned. If the end of the input
+// is reached before the close rune, the rest of the input is accepted
+// and false is returned
+func (l *Lexer) AcceptQuoted(open, close, escape rune) bool {
+	if !l.acceptRune(open) {
+		return false
+	}
+
+	for {
+		r := l.Next()
+		switch {
+		case l.Width == 0:
+			return false
+		case r == escape:
+			l.Next()
+		case r == close:
+			return true
+		}
+	}
+}
+
+// AcceptUntilUnescapedStripped behaves like AcceptUntilUnescaped
+// but also returns the accepted text with the escape runes removed.
+// Nothing is emitted
+func (l *Lexer) AcceptUntilUnescapedStripped(delims string) string {
+	start := l.Pos
+	l.AcceptUntilUnescaped(delims)
+
+	escape := l.escapeRune()
+	var b strings.Builder
+	inEscape := false
+	for _, r := range l.Text[start:l.Pos] {
+		if r == escape && !inEscape {
+			inEscape = true
+			continue
+		}
+		inEscape = false
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// Indent increases the nesting depth by one
+func (l *Lexer) Indent() {
+	l.Depth++
+}
+
+// Dedent decreases the nesting depth by one,
+// but never below zero
+func (l *Lexer) Dedent() {
+	if l.Depth > 0 {
+		l.Depth--
+	}
+}
+
+// AcceptRunSpaceNoNewline continually accepts spaces, tabs,
+// carriage returns, vertical tabs and form feeds, stopping
+// at a newline. It returns how many runes were accepted
+func (l *Lexer) AcceptRunSpaceNoNewline() int {
+	return l.AcceptRun(" \t\r\v\f")
+}
+
+// AcceptDelimitedRun accepts an opening run of one or more marker
+// runes, the content after it, and a closing run of the same number
+// of marker runes. The content between the runs is returned. If
+// there is no opening run, or no matching closing run, nothing is
+// accepted and false is returned
+func (l *Lexer) AcceptDelimitedRun(marker rune) (string, bool) {
+	start := l.Pos
+
+	n := l.countRun(marker)
+	if n == 0 {
+		return "", false
+	}
+
+	contentStart := l.Pos
+	for {
+		contentEnd := l.Pos
+		if m := l.countRun(marker); m == n {
+			return l.Text[contentStart:contentEnd], true
+		} else if m > 0 {
+			continue
+		}
+
+		l.Next()
+		if l.Width == 0 {
+			l.rewind(start)
+			return "", false
+		}
+	}
+}
+
+// countRun accepts a run of the rune r and returns its length
+func (l *Lexer) countRun(r rune) int {
+	n := 0
+	for l.Next() == r && l.Width > 0 {
+		n++
+	}
+	l.Backup()
+	return n
+}
+
+// AcceptRunFuncUnescaped continually accepts runes for as long
+// as the runeCheck function returns true. A rune that follows
+// the escape rune is always accepted
+func (l *Lexer) AcceptRunFuncUnescaped(fn RuneCheck, escape rune) {
+	for {
+		r := l.Next()
+		if l.Width == 0 {
+			return
+		}
+
+		if r == escape {
+			l.Next()
+			continue
+		}
+
+		if !fn(r) {
+			l.Backup()
+			return
+		}
+	}
+}
+
+// Pending returns the text of the current, not yet
+// emitted, token; e.g. to check if it's a keyword
+func (l *Lexer) Pending() string {
+	return l.Text[l.TokenStart:l.Pos]
+}
+
+// CountPending returns the number of times the rune r
+// appears in the current, not yet emitted, token
+func (l *Lexer) CountPending(r rune) int {
+	return strings.Count(l.Pending(), string(r))
+}
+
+// AcceptString accepts s if the input at the
+// current position starts with it
+func (l *Lexer) AcceptString(s string) bool {
+	l.fill(len(s))
+	if !strings.HasPrefix(l.Text[l.Pos:], s) {
+		return false
+	}
+	l.advance(len(s))
+	return true
+}
+
+// AcceptStringFold accepts the text at the current position if it is
+// equal to s under Unicode case folding, e.g. so that SELECT, select
+// and Select all match "select". The accepted text is not changed
+func (l *Lexer) AcceptStringFold(s string) bool {
+	l.fill(len(s) * utf8.UTFMax)
+
+	pos := l.Pos
+	for _, want := range s {
+		if pos >= len(l.Text) {
+			return false
+		}
+		r, w := l.decodeRune(l.Text[pos:])
+		if !equalFold(r, want) {
+			return false
+		}
+		pos += w
+	}
+
+	l.advance(pos - l.Pos)
+	return true
+}
+
+// equalFold returns true if a and b are equal
+// under simple Unicode case folding
+func equalFold(a, b rune) bool {
+	if a == b {
+		return true
+	}
+	for f := unicode.SimpleFold(a); f != a; f = unicode.SimpleFold(f) {
+		if f == b {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptRegexp accepts the text matched by re if the match starts
+// at the current position. An empty match is not accepted. Patterns
+// should start with ^ so that they don't search the rest of the input
+// for a match when there isn't one at the current position
+func (l *Lexer) AcceptRegexp(re *regexp.Regexp) bool {
+	loc := re.FindReaderIndex(&inputReader{l: l, pos: l.Pos})
+	if loc == nil || loc[0] != 0 || loc[1] == 0 {
+		return false
+	}
+	l.advance(loc[1])
+	return true
+}
+
+// inputReader is an io.RuneReader over the input of a Lexer
+// from a position, that doesn't move the Lexer's position
+type inputReader struct {
+	l   *Lexer
+	pos int
+}
+
+func (r *inputReader) ReadRune() (rune, int, error) {
+	r.l.fill(r.pos - r.l.Pos + utf8.UTFMax)
+	if r.pos >= len(r.l.Text) {
+		return 0, 0, io.EOF
+	}
+
+	c, w := r.l.decodeRune(r.l.Text[r.pos:])
+	r.pos += w
+	return c, w, nil
+}
+
+// AcceptOperator accepts the longest of the provided operators
+// that matches the input at the current position and returns it.
+// If none of them match, nothing is accepted and false is returned
+func (l *Lexer) AcceptOperator(ops []string) (string, bool) {
+	max := 0
+	for _, op := range ops {
+		if len(op) > max {
+			max = len(op)
+		}
+	}
+	l.fill(max)
+	rest := l.Text[l.Pos:]
+
+	longest := ""
+	for _, op := range ops {
+		if len(op) > len(longest) && strings.HasPrefix(rest, op) {
+			longest = op
+		}
+	}
+
+	if longest == "" {
+		return "", false
+	}
+	l.advance(len(longest))
+	return longest, true
+}
+
+// AcceptAnyOf accepts the longest of the provided words that
+// matches the input at the current position and returns it.
+// If none of them match, nothing is accepted and false is returned
+func (l *Lexer) AcceptAnyOf(words ...string) (string, bool) {
+	return l.AcceptOperator(words)
+}
+
+// advance calls Next until the current position
+// has moved on by n bytes
+func (l *Lexer) advance(n int) {
+	for end := l.Pos + n; l.Pos < end; {
+		if l.Next(); l.Width == 0 {
+			return
+		}
+	}
+}
+
+// TokenStartRune returns the first rune of the current token
+// without moving the current position, or EOF if the token
+// starts at the end of the input
+func (l *Lexer) TokenStartRune() rune {
+	if l.TokenStart >= len(l.Text) {
+		return EOF
+	}
+	r, _ := l.decodeRune(l.Text[l.TokenStart:])
+	return r
+}
+
+// AcceptRepeated accepts between min and max consecutive occurrences
+// of the rune r and returns how many were accepted. If there are
+// fewer than min occurrences nothing is accepted and 0 is returned
+func (l *Lexer) AcceptRepeated(r rune, min, max int) int {
+	start := l.Pos
+
+	n := 0
+	for n < max && l.Next() == r && l.Width > 0 {
+		n++
+	}
+	if n < max {
+		l.Backup()
+	}
+
+	if n < min {
+		l.rewind(start)
+		return 0
+	}
+	return n
+}
+
+// rewind moves the current position back to pos, which
+// must be at the start of a rune that was already read
+func (l *Lexer) rewind(pos int) {
+	l.Line -= strings.Count(l.Text[pos:l.Pos], "\n")
+	l.Column = l.columnAt(pos)
+	l.Pos = pos
+	l.Width = 0
+	l.hist.clear()
+}
+
+// AtLineStart returns true if the current token starts
+// at the beginning of a line
+func (l *Lexer) AtLineStart() bool {
+	if l.TokenStart == 0 || l.TokenStart+l.discarded == l.bom.size() {
+		return true
+	}
+	return l.Text[l.TokenStart-1] == '\n'
+}
+
+// AcceptBalanced accepts an open rune and runes up to and including
+// the matching close rune, allowing for nested open and close runes.
+// If the next rune is not the open rune, or the end of the input is
+// reached first, nothing is accepted and false is returned
+func (l *Lexer) AcceptBalanced(open, close rune) bool {
+	start := l.Pos
+	if !l.acceptRune(open) {
+		return false
+	}
+
+	if _, ok := l.AcceptUntilBalanced(open, close); !ok {
+		l.rewind(start)
+		return false
+	}
+	return true
+}
+
+// AcceptUntilBalanced should be called just after an open rune has
+// been accepted. It accepts runes up to and including the matching
+// close rune, allowing for nested open and close runes, and returns
+// the text between the outer open and close runes. If the end of the
+// input is reached first nothing is accepted and false is returned
+func (l *Lexer) AcceptUntilBalanced(open, close rune) (string, bool) {
+	start := l.Pos
+	depth := 1
+	for {
+		r := l.Next()
+		if l.Width == 0 {
+			l.rewind(start)
+			return "", false
+		}
+
+		switch r {
+		case open:
+			depth++
+		case close:
+			depth--
+		}
+
+		if depth == 0 {
+			return l.Text[start : l.Pos-l.Width], true
+		}
+	}
+}
+
+// Append adds text to the end of the input
+func (l *Lexer) Append(text string) {
+	l.Text += text
+	l.runeLen = -1
+}
+
+// ByteLen returns the length of the input in bytes. For
+// lexers from NewReader it's the length of the input read so
+// far, including any input discarded by WithWindow
+func (l *Lexer) ByteLen() int {
+	return len(l.Text) + l.discarded
+}
+
+// RuneLen returns the length of the input in runes. The length
+// is only counted once and is then cached. For lexers from
+// NewReader it's the length of the input read so far,
+// including any input discarded by WithWindow
+func (l *Lexer) RuneLen() int {
+	if l.runeLen < 0 {
+		l.runeLen = l.cutRunes + utf8.RuneCountInString(l.Text)
+	}
+	return l.runeLen
+}
+
+// AcceptInt accepts an integer in the given base and returns its
+// value. Base 10 integers may have a leading + or -. If there is
+// no valid integer nothing is accepted and false is returned
+func (l *Lexer) AcceptInt(base int) (int64, bool) {
+	start := l.Pos
+	if base == 10 {
+		l.Accept("+-")
+	}
+
+	digits := l.Pos
+	l.AcceptRunFunc(func(r rune) bool {
+		return digitVal(r) < base
+	})
+
+	if l.Pos == digits {
+		l.rewind(start)
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(l.Text[start:l.Pos], base, 64)
+	if err != nil {
+		l.rewind(start)
+		return 0, false
+	}
+	return n, true
+}
+
+// AcceptFloat accepts a decimal floating point number, with an
+// optional sign, fraction and exponent, and returns its value. If
+// there is no valid number nothing is accepted and false is returned
+func (l *Lexer) AcceptFloat() (float64, bool) {
+	start := l.Pos
+	l.Accept("+-")
+
+	digits := l.acceptDigits()
+	if l.Accept(".") {
+		digits += l.acceptDigits()
+	}
+
+	if digits == 0 {
+		l.rewind(start)
+		return 0, false
+	}
+
+	exp := l.Pos
+	if l.Accept("eE") {
+		l.Accept("+-")
+		if l.acceptDigits() == 0 {
+			l.rewind(exp)
+		}
+	}
+
+	f, err := strconv.ParseFloat(l.Text[start:l.Pos], 64)
+	if err != nil {
+		l.rewind(start)
+		return 0, false
+	}
+	return f, true
+}
+
+// acceptDigits accepts a run of 0-9 and returns its length
+func (l *Lexer) acceptDigits() int {
+	start := l.Pos
+	l.AcceptRunFunc(IsASCIIDigit)
+	return l.Pos - start
+}
+
+// digitVal returns the value of r as a digit in bases up
+// to 36, or 36 if r is not a digit in any of them
+func digitVal(r rune) int {
+	switch {
+	case '0' <= r && r <= '9':
+		return int(r - '0')
+	case 'a' <= r && r <= 'z':
+		return int(r-'a') + 10
+	case 'A' <= r && r <= 'Z':
+		return int(r-'A') + 10
+	}
+	return 36
+}
+
+// Splice inserts tokens into the token slice at index at, e.g.
+// to include tokens lexed from another input
+func (l *Lexer) Splice(at int, tokens []Token) {
+	ts := make([]Token, 0, len(l.Tokens)+len(tokens))
+	ts = append(ts, l.Tokens[:at]...)
+	ts = append(ts, tokens...)
+	l.Tokens = append(ts, l.Tokens[at:]...)
+	l.unEmit = -1
+}
+
+// SpliceWithOffset inserts tokens into the token slice at index at
+// like Splice, first moving the positions of any PosTokens among
+// them on by byteOffset
+func (l *Lexer) SpliceWithOffset(at, byteOffset int, tokens []Token) {
+	for _, t := range tokens {
+		if pt, ok := t.(PosToken); ok {
+			start, end := pt.Pos()
+			pt.SetPos(start+byteOffset, end+byteOffset)
+		}
+	}
+	l.Splice(at, tokens)
+}
+
+// AcceptKeyValue accepts a key up to the sep rune, the sep rune,
+// and a value up to the pairDelim rune or the end of the input,
+// and returns the key and value. The pairDelim rune is not
+// accepted. If there is no sep rune before the next pairDelim
+// rune nothing is accepted and false is returned
+func (l *Lexer) AcceptKeyValue(sep, pairDelim rune) (key, value string, ok bool) {
+	start := l.Pos
+
+	l.AcceptUntil(string([]rune{sep, pairDelim}))
+	if !l.acceptRune(sep) {
+		l.rewind(start)
+		return "", "", false
+	}
+	key = l.Text[start : l.Pos-l.Width]
+
+	valueStart := l.Pos
+	l.AcceptUntil(string(pairDelim))
+	return key, l.Text[valueStart:l.Pos], true
+}
+
+// acceptRune moves the pointer if the next rune is r
+func (l *Lexer) acceptRune(r rune) bool {
+	if l.Next() == r && l.Width > 0 {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// A Checkpoint is a saved Lexer state that can be returned to
+// with Restore
+type Checkpoint struct {
+	pos, width, tokenStart int
+	discarded              int
+	cur, prev              rune
+	line, column           int
+	tokens, emitted        int
+	lastStart, prevStart   int
+	trivia                 string
+	hist                   history
+}
+
+// Checkpoint saves the current state of the Lexer so that it can
+// be returned to with Restore, e.g. to try lexing one construct
+// and fall back to another if that fails
+func (l *Lexer) Checkpoint() Checkpoint {
+	return Checkpoint{
+		pos:        l.Pos,
+		width:      l.Width,
+		tokenStart: l.TokenStart,
+		discarded:  l.discarded,
+		cur:        l.Cur,
+		prev:       l.Prev,
+		line:       l.Line,
+		column:     l.Column,
+		tokens:     len(l.Tokens),
+		emitted:    l.emitted,
+		lastStart:  l.lastStart,
+		prevStart:  l.prevStart,
+		trivia:     l.trivia,
+		hist:       l.hist.clone(),
+	}
+}
+
+// Restore returns the Lexer to the state saved in a Checkpoint,
+// removing any tokens emitted since the Checkpoint was made. It
+// returns ErrDiscarded and does nothing if the input at the
+// Checkpoint has since been discarded by a Lexer created with
+// WithWindow. Once lexing has halted Restore does nothing and
+// returns the error that halted it, so that halting can't be
+// undone and any ErrorToken added when it halted is kept
+func (l *Lexer) Restore(cp Checkpoint) error {
+	if l.err != nil {
+		return l.err
+	}
+
+	shift := l.discarded - cp.discarded
+	// EmitCoalesce needs the start of the last token too
+	if cp.pos-shift < 0 || cp.tokenStart-shift < 0 || cp.tokens > 0 && cp.lastStart-shift < 0 {
+		return ErrDiscarded
+	}
+
+	l.Pos = cp.pos - shift
+	l.Width = cp.width
+	l.TokenStart = cp.tokenStart - shift
+	l.Cur = cp.cur
+	l.Prev = cp.prev
+	l.Line = cp.line
+	l.Column = cp.column
+	l.trivia = cp.trivia
+	l.hist.restore(cp.hist)
+
+	if cp.tokens < len(l.Tokens) {
+		l.Tokens = l.Tokens[:cp.tokens]
 	}
+	l.emitted = cp.emitted
+	l.lastStart = cp.lastStart - shift
+	l.prevStart = cp.prevStart - shift
+	l.unEmit = -1
+	l.snapshotLineCol()
+	return nil
 }
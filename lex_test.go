@@ -1,8 +1,18 @@
 package rplex
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 	"unicode"
+	"unicode/utf8"
 )
 
 type testToken struct {
@@ -128,6 +138,38 @@ func TestAcceptFunc(t *testing.T) {
 	}
 }
 
+func TestAcceptRunCounts(t *testing.T) {
+	l := New("aab12é é  \nx")
+
+	if n := l.AcceptRun("ab"); n != 3 {
+		t.Errorf("have AcceptRun count %d; want 3", n)
+	}
+
+	if n := l.AcceptRunBetween('0', '9'); n != 2 {
+		t.Errorf("have AcceptRunBetween count %d; want 2", n)
+	}
+
+	if n := l.AcceptRunStoppingAt("é ", " "); n != 1 {
+		t.Errorf("have AcceptRunStoppingAt count %d; want 1", n)
+	}
+
+	if n := l.AcceptRunExcept("\n"); n != 4 {
+		t.Errorf("have AcceptRunExcept count %d; want 4", n)
+	}
+
+	if n := l.AcceptRun("xyz"); n != 0 {
+		t.Errorf("have AcceptRun count %d; want 0", n)
+	}
+
+	l.Accept("\n")
+	n := l.AcceptRunFunc(func(r rune) bool {
+		return r != '"'
+	})
+	if n != 1 || l.Pos != len(l.Text) {
+		t.Errorf("have AcceptRunFunc count %d at pos %d; want 1 at %d", n, l.Pos, len(l.Text))
+	}
+}
+
 func TestAcceptRunFunc(t *testing.T) {
 	l := New("123a")
 
@@ -200,3 +242,2624 @@ func TestAcceptUntilUnescaped(t *testing.T) {
 	}
 
 }
+
+func TestAcceptArgument(t *testing.T) {
+	l := New("f(a, g(b, c), d)")
+
+	var terms []rune
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptUntil("(")
+		l.Accept("(")
+		l.Ignore()
+
+		for {
+			_, term := l.AcceptArgument(",", '(', ')')
+			l.Emit(&testToken{})
+			terms = append(terms, term)
+
+			if term != ',' {
+				return nil
+			}
+			l.Accept(",")
+			l.AcceptRun(" ")
+			l.Ignore()
+		}
+	})
+
+	want := []string{"a", "g(b, c)", "d"}
+	if len(ts) != len(want) {
+		t.Fatalf("have length %d; want %d", len(ts), len(want))
+	}
+
+	for i, w := range want {
+		if ts[i].Text() != w {
+			t.Errorf("have text '%s'; want '%s'", ts[i].Text(), w)
+		}
+	}
+
+	if terms[2] != ')' {
+		t.Errorf("have terminator '%c'; want ')'", terms[2])
+	}
+}
+
+func TestAcceptExcept(t *testing.T) {
+	l := New(`a"`)
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		if !l.AcceptExcept(`"\`) {
+			t.Errorf("want 'a' to be accepted")
+		}
+		if l.AcceptExcept(`"\`) {
+			t.Errorf("want '\"' not to be accepted")
+		}
+		l.Emit(&testToken{})
+
+		l.Accept(`"`)
+		if l.AcceptExcept(`"\`) {
+			t.Errorf("want EOF not to be accepted")
+		}
+		l.Emit(&testToken{})
+
+		return nil
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	if ts[0].Text() != "a" {
+		t.Errorf("have text '%s'; want 'a'", ts[0].Text())
+	}
+
+	if ts[1].Text() != `"` {
+		t.Errorf(`have text '%s'; want '"'`, ts[1].Text())
+	}
+}
+
+func TestAcceptRunExcept(t *testing.T) {
+	l := New(`abc"def`)
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptRunExcept(`"`)
+		l.Emit(&testToken{})
+
+		l.Accept(`"`)
+		l.Ignore()
+
+		l.AcceptRunExcept(`"`)
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	if ts[0].Text() != "abc" {
+		t.Errorf("have text '%s'; want 'abc'", ts[0].Text())
+	}
+
+	if ts[1].Text() != "def" {
+		t.Errorf("have text '%s'; want 'def'", ts[1].Text())
+	}
+}
+
+func TestSkipSpaces(t *testing.T) {
+	lexWords := func(l *Lexer) LexFn {
+		for l.Peek() != EOF {
+			l.AcceptRunFunc(unicode.IsLetter)
+			l.Emit(&testToken{})
+			l.SkipSpaces()
+		}
+		return nil
+	}
+
+	ts := New("one two  three").Run(lexWords)
+	if len(ts) != 3 {
+		t.Fatalf("have length %d; want 3", len(ts))
+	}
+
+	ts = New("one two  three", WithWhitespaceTokens(func() Token {
+		return &testToken{}
+	})).Run(lexWords)
+	if len(ts) != 5 {
+		t.Fatalf("have length %d; want 5", len(ts))
+	}
+
+	if ts[3].Text() != "  " {
+		t.Errorf("have text '%s'; want '  '", ts[3].Text())
+	}
+}
+
+func TestIgnoreRun(t *testing.T) {
+	l := New("--  \tkey=1", WithWhitespaceTokens(func() Token {
+		return &testToken{}
+	}))
+
+	if n := l.IgnoreRun("-"); n != 2 {
+		t.Errorf("have %d runes ignored; want 2", n)
+	}
+
+	if n := l.SkipWhitespace(); n != 3 {
+		t.Errorf("have %d runes skipped; want 3", n)
+	}
+
+	if n := l.IgnoreRunFunc(unicode.IsLetter); n != 3 {
+		t.Errorf("have %d runes ignored; want 3", n)
+	}
+
+	l.AcceptRun("=1")
+	l.Emit(&testToken{})
+
+	if len(l.Tokens) != 1 || l.Tokens[0].Text() != "=1" {
+		t.Errorf("have tokens %v; want a single '=1' token", l.Tokens)
+	}
+}
+
+func TestAcceptUntilFound(t *testing.T) {
+	l := New(`"abc" "def`)
+
+	l.Accept(`"`)
+	if !l.AcceptUntil(`"`) {
+		t.Errorf("want closing quote to be found")
+	}
+
+	l.AcceptRun(`" `)
+	if l.AcceptUntil(`"`) {
+		t.Errorf("want AcceptUntil to report EOF without a closing quote")
+	}
+
+	if l.Pos != len(l.Text) {
+		t.Errorf("have pos %d; want %d", l.Pos, len(l.Text))
+	}
+}
+
+func TestAcceptUntilUnescapedFound(t *testing.T) {
+	l := New(`a\"b"c`)
+
+	if !l.AcceptUntilUnescaped(`"`) {
+		t.Errorf("want unescaped quote to be found")
+	}
+
+	l.Accept(`"`)
+	if l.AcceptUntilUnescaped(`"`) {
+		t.Errorf("want AcceptUntilUnescaped to report EOF without a quote")
+	}
+}
+
+func TestRunParallel(t *testing.T) {
+	input := strings.Repeat("one two\nthree four five\nsix\n", 50)
+
+	lexWords := func(l *Lexer) LexFn {
+		for {
+			l.AcceptRunFunc(unicode.IsSpace)
+			l.Ignore()
+			if l.Peek() == EOF {
+				return nil
+			}
+			l.AcceptRunFunc(unicode.IsLetter)
+			l.Emit(&posToken{})
+		}
+	}
+
+	want := New(input).Run(lexWords)
+	have := New(input).RunParallel(func(s string) []string {
+		return strings.SplitAfter(s, "\n")
+	}, lexWords, 4)
+
+	if len(have) != len(want) {
+		t.Fatalf("have length %d; want %d", len(have), len(want))
+	}
+
+	for i := range want {
+		if have[i].Text() != want[i].Text() {
+			t.Fatalf("have text '%s' at %d; want '%s'", have[i].Text(), i, want[i].Text())
+		}
+
+		hs, _ := have[i].(PosToken).Pos()
+		ws, _ := want[i].(PosToken).Pos()
+		if hs != ws {
+			t.Fatalf("have start %d at %d; want %d", hs, i, ws)
+		}
+	}
+}
+
+func TestRunParallelBadSplit(t *testing.T) {
+	splits := map[string]func(string) []string{
+		"copied":    func(s string) []string { return []string{strings.ToUpper(s)} },
+		"reordered": func(s string) []string { return []string{s[4:], s[:4]} },
+	}
+
+	for name, split := range splits {
+		l := New("one\none\n")
+		ts := l.RunParallel(split, lexBenchWords, 2)
+		if l.Err() == nil || len(ts) != 0 {
+			t.Errorf("%s: have tokens %v and error %v; want no tokens and an error", name, ts, l.Err())
+		}
+	}
+
+	// Chunks are placed by where they are rather than by their
+	// text, so the second "one" isn't mistaken for the first
+	l := New("one\none\n")
+	ts := l.RunParallel(func(s string) []string { return []string{s[4:]} }, func(l *Lexer) LexFn {
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.Emit(&posToken{})
+		return nil
+	}, 2)
+	if s, _ := ts[0].(PosToken).Pos(); s != 4 {
+		t.Errorf("have token at %d; want 4", s)
+	}
+}
+
+func TestRunParallelChunkState(t *testing.T) {
+	lines := func(s string) []string {
+		return strings.SplitAfter(s, "\n")
+	}
+	lexLine := func(l *Lexer) LexFn {
+		l.AcceptRunExcept("\n")
+		l.Emit(&lineColToken{})
+		l.Accept("\n")
+		l.Ignore()
+		return nil
+	}
+
+	l := New("one\ntwo\nthree")
+	ts := l.RunParallel(lines, lexLine, 2)
+	for i, tok := range ts {
+		if lc := tok.(*lineColToken); lc.line != i+1 || lc.col != 1 {
+			t.Errorf("have token %q at %d:%d; want %d:1", lc.Text(), lc.line, lc.col, i+1)
+		}
+	}
+
+	l = New("one\nt\xffo\nthree\n", WithInvalidRune(InvalidError))
+	ts = l.RunParallel(lines, lexLine, 2)
+	if l.Err() == nil || l.Err().Error() != "rplex: invalid UTF-8 at byte 5" {
+		t.Errorf("have error %v; want invalid UTF-8 at byte 5", l.Err())
+	}
+	if len(ts) != 2 || ts[1].Text() != "t" {
+		t.Errorf("have tokens %v; want 'one' and 't'", ts)
+	}
+
+	l = New("one\nt\xffo\n", WithInvalidRune(InvalidReport))
+	l.RunParallel(lines, lexLine, 2)
+	if d := l.Diagnostics(); len(d) != 1 || d[0].Pos != 5 {
+		t.Errorf("have diagnostics %v; want one at byte 5", d)
+	}
+}
+
+func TestContext(t *testing.T) {
+	l := New("let x = 1 +* 2")
+
+	if c := l.Context(10, 12, 2); c != "1 +* 2" {
+		t.Errorf("have context '%s'; want '1 +* 2'", c)
+	}
+
+	if c := l.Context(1, 3, 5); c != "let x = " {
+		t.Errorf("have context '%s'; want 'let x = '", c)
+	}
+
+	if c := l.Context(10, 12, 4); c != "= 1 +* 2" {
+		t.Errorf("have context '%s'; want '= 1 +* 2'", c)
+	}
+}
+
+func TestAcceptLine(t *testing.T) {
+	l := New("one\ntwo 2\nthree")
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.SkipLine()
+		l.Accept("\n")
+		l.Ignore()
+
+		l.AcceptLine()
+		l.Emit(&testToken{})
+		l.Accept("\n")
+		l.Ignore()
+
+		l.AcceptLine()
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	if ts[0].Text() != "two 2" {
+		t.Errorf("have text '%s'; want 'two 2'", ts[0].Text())
+	}
+
+	if ts[1].Text() != "three" {
+		t.Errorf("have text '%s'; want 'three'", ts[1].Text())
+	}
+}
+
+func TestRuneScanner(t *testing.T) {
+	l := New("héllo, world")
+	rs := l.RuneScanner()
+
+	var have []rune
+	for {
+		r, _, err := rs.ReadRune()
+		if err != nil {
+			if err != io.EOF {
+				t.Fatalf("have error %s; want io.EOF", err)
+			}
+			break
+		}
+		if r == ',' {
+			rs.UnreadRune()
+			break
+		}
+		have = append(have, r)
+	}
+
+	if string(have) != "héllo" {
+		t.Errorf("have runes '%s'; want 'héllo'", string(have))
+	}
+
+	if err := rs.UnreadRune(); err == nil {
+		t.Errorf("want error for UnreadRune without ReadRune")
+	}
+
+	r, w, _ := rs.ReadRune()
+	if r != ',' || w != 1 {
+		t.Errorf("have rune '%c' width %d; want ',' width 1", r, w)
+	}
+
+	for {
+		if _, _, err := rs.ReadRune(); err == io.EOF {
+			break
+		}
+	}
+
+	if l.Pos != len(l.Text) {
+		t.Errorf("have pos %d; want %d", l.Pos, len(l.Text))
+	}
+}
+
+func TestWithInvalidRune(t *testing.T) {
+	input := "ab\xffcd"
+	lexAll := func(l *Lexer) LexFn {
+		l.AcceptRunExcept("")
+		l.Emit(&testToken{})
+		return nil
+	}
+
+	l := New(input)
+	ts := l.Run(lexAll)
+	if ts[0].Text() != input {
+		t.Errorf("have text '%q'; want '%q'", ts[0].Text(), input)
+	}
+
+	l = New(input, WithInvalidRune(InvalidSkip))
+	var runes []rune
+	for r := l.Next(); l.Width > 0; r = l.Next() {
+		runes = append(runes, r)
+	}
+	if string(runes) != "abcd" {
+		t.Errorf("have runes '%s'; want 'abcd'", string(runes))
+	}
+
+	l = New("ab\xff\xfe", WithInvalidRune(InvalidSkip))
+	runes = runes[:0]
+	for r := l.Next(); l.Width > 0; r = l.Next() {
+		runes = append(runes, r)
+	}
+	if string(runes) != "ab" || !l.AtEOF() {
+		t.Errorf("have runes '%s' and AtEOF %t; want 'ab' and the trailing bytes skipped", string(runes), l.AtEOF())
+	}
+
+	l = New(input, WithInvalidRune(InvalidError))
+	ts = l.Run(func(l *Lexer) LexFn {
+		lexAll(l)
+		return func(l *Lexer) LexFn {
+			t.Errorf("want lexing to halt after an invalid byte")
+			return nil
+		}
+	})
+	if l.Err() == nil {
+		t.Errorf("want non-nil error for invalid byte")
+	}
+	if ts[0].Text() != "ab" {
+		t.Errorf("have text '%s'; want 'ab'", ts[0].Text())
+	}
+
+	l = New("a\xffb\xfe", WithInvalidRune(InvalidReport))
+	l.Peek()
+	ts = l.Run(lexAll)
+	if ts[0].Text() != "a\xffb\xfe" {
+		t.Errorf("have text '%q'; want the invalid bytes kept", ts[0].Text())
+	}
+	diags := l.Diagnostics()
+	if len(diags) != 2 {
+		t.Fatalf("have %d diagnostics; want 2", len(diags))
+	}
+	if diags[0].Pos != 1 || diags[1].Pos != 3 {
+		t.Errorf("have diagnostics at %d and %d; want 1 and 3", diags[0].Pos, diags[1].Pos)
+	}
+
+	var lexFields LexFn
+	lexFields = func(l *Lexer) LexFn {
+		l.AcceptRunExcept(" ")
+		l.Emit(&testToken{})
+		if !l.Accept(" ") {
+			return nil
+		}
+		l.Ignore()
+		return lexFields
+	}
+	l = New("ab c\xffd ef", WithInvalidRune(InvalidToken))
+	ts = l.Run(lexFields)
+	if len(ts) != 3 {
+		t.Fatalf("have %d tokens; want 3", len(ts))
+	}
+	et, ok := ts[1].(*ErrorToken)
+	if !ok || et.Text() != "c\xffd" || et.Msg != "invalid UTF-8 byte 0xff" {
+		t.Errorf("have token %#v; want an ErrorToken for 'c\\xffd'", ts[1])
+	}
+	if _, ok := ts[2].(*testToken); !ok || ts[2].Text() != "ef" {
+		t.Errorf("have token %#v; want lexing to carry on after the ErrorToken", ts[2])
+	}
+}
+
+func TestLastTokenText(t *testing.T) {
+	l := New("abc")
+
+	if l.LastToken() != nil {
+		t.Errorf("want nil last token before emitting")
+	}
+
+	if txt := l.LastTokenText(); txt != "" {
+		t.Errorf("have text '%s'; want ''", txt)
+	}
+
+	l.AcceptRun("ab")
+	l.Emit(&testToken{})
+
+	if txt := l.LastTokenText(); txt != "ab" {
+		t.Errorf("have text '%s'; want 'ab'", txt)
+	}
+
+	if l.LastToken() != l.Tokens[0] {
+		t.Errorf("want last token to be the emitted token")
+	}
+}
+
+func TestAcceptUntilUnescapedStripped(t *testing.T) {
+	l := New(`a\"b\"c"`)
+
+	s := l.AcceptUntilUnescapedStripped(`"`)
+	if s != `a"b"c` {
+		t.Errorf(`have string '%s'; want 'a"b"c'`, s)
+	}
+
+	if l.Pos != len(l.Text)-1 {
+		t.Errorf("have pos %d; want %d", l.Pos, len(l.Text)-1)
+	}
+
+	if l.Peek() != '"' {
+		t.Errorf(`have next rune '%c'; want '"'`, l.Peek())
+	}
+}
+
+type eofToken struct {
+	TextToken
+}
+
+func TestWithEOFToken(t *testing.T) {
+	lexAll := func(l *Lexer) LexFn {
+		l.AcceptRunExcept("")
+		l.Emit(&testToken{})
+		return nil
+	}
+
+	ts := New("abc").Run(lexAll)
+	for _, tok := range ts {
+		if _, ok := tok.(*eofToken); ok {
+			t.Errorf("want no EOF token without WithEOFToken")
+		}
+	}
+
+	l := New("abc", WithEOFToken(func() Token {
+		return &eofToken{}
+	}))
+	l.Run(lexAll)
+	ts = l.Run(lexAll)
+
+	if len(ts) != 3 {
+		t.Fatalf("have length %d; want 3", len(ts))
+	}
+
+	if _, ok := ts[1].(*eofToken); !ok {
+		t.Errorf("want EOF token after the last token; have %T", ts[1])
+	}
+
+	if ts[1].Text() != "" {
+		t.Errorf("have text '%s'; want ''", ts[1].Text())
+	}
+
+	if _, ok := ts[2].(*eofToken); ok {
+		t.Errorf("want EOF token to be emitted only once")
+	}
+}
+
+func TestDepth(t *testing.T) {
+	l := New("{{}}}")
+
+	max := 0
+	for r := l.Next(); l.Width > 0; r = l.Next() {
+		switch r {
+		case '{':
+			l.Indent()
+		case '}':
+			l.Dedent()
+		}
+		if l.Depth > max {
+			max = l.Depth
+		}
+	}
+
+	if max != 2 {
+		t.Errorf("have max depth %d; want 2", max)
+	}
+
+	if l.Depth != 0 {
+		t.Errorf("have depth %d; want 0", l.Depth)
+	}
+}
+
+func TestAcceptRunSpaceNoNewline(t *testing.T) {
+	l := New("  \t\n")
+
+	l.AcceptRunSpaceNoNewline()
+
+	if l.Pos != 3 {
+		t.Errorf("have pos %d; want 3", l.Pos)
+	}
+
+	if l.Peek() != '\n' {
+		t.Errorf("have next rune '%q'; want '\\n'", l.Peek())
+	}
+}
+
+func TestEmitCoalesce(t *testing.T) {
+	l := New("abc;def")
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptRun("abc")
+		l.EmitCoalesce(&testToken{})
+
+		l.Accept(";")
+		l.EmitCoalesce(&eofToken{})
+
+		l.AcceptRun("de")
+		l.EmitCoalesce(&testToken{})
+
+		l.Accept("f")
+		l.EmitCoalesce(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 3 {
+		t.Fatalf("have length %d; want 3", len(ts))
+	}
+
+	if ts[2].Text() != "def" {
+		t.Errorf("have text '%s'; want 'def'", ts[2].Text())
+	}
+}
+
+type kindToken struct {
+	TextToken
+	TypedToken
+}
+
+const (
+	kindWord Kind = iota
+	kindNumber
+)
+
+func TestEmitKind(t *testing.T) {
+	ts := New("ab12c").Run(func(l *Lexer) LexFn {
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.EmitKind(&kindToken{}, kindWord)
+		l.Accept("1")
+		l.EmitKind(&kindToken{}, kindNumber)
+		l.Accept("2")
+		l.EmitCoalesce(&kindToken{TypedToken: TypedToken{kindNumber}})
+		l.Accept("c")
+		l.EmitCoalesce(&kindToken{TypedToken: TypedToken{kindWord}})
+		return nil
+	})
+
+	var have []string
+	for _, tok := range ts {
+		switch tok.(KindToken).Kind() {
+		case kindWord:
+			have = append(have, "word:"+tok.Text())
+		case kindNumber:
+			have = append(have, "number:"+tok.Text())
+		}
+	}
+
+	want := "word:ab number:12 word:c"
+	if strings.Join(have, " ") != want {
+		t.Errorf("have tokens '%s'; want '%s'", strings.Join(have, " "), want)
+	}
+}
+
+func TestWithTrace(t *testing.T) {
+	var trace strings.Builder
+	// The runtime's name for a LexFn depends on where
+	// the package is, so it's given a name of its own
+	l := New("one two", WithTrace(&trace))
+	l.RegisterState("words", lexBenchWords)
+	l.Run(lexBenchWords)
+
+	want := []string{
+		"rplex: 1:1: state words",
+		`rplex: emit *rplex.testToken "one" at byte 0`,
+		`rplex: emit *rplex.testToken "two" at byte 4`,
+		`rplex: 1:8: accepted "one two"`,
+	}
+
+	lines := strings.Split(strings.TrimSpace(trace.String()), "\n")
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("have trace:\n%s\nwant:\n%s", trace.String(), strings.Join(want, "\n"))
+	}
+}
+
+func TestWithTraceParallel(t *testing.T) {
+	var trace bytes.Buffer
+	l := New("one\ntwo\nthree\n", WithTrace(&trace))
+	l.RegisterState("words", lexBenchWords)
+	l.RunParallel(func(s string) []string {
+		return strings.SplitAfter(s, "\n")
+	}, lexBenchWords, 3)
+
+	var emits []string
+	for _, line := range strings.Split(trace.String(), "\n") {
+		if strings.Contains(line, "emit") {
+			emits = append(emits, line)
+		}
+	}
+
+	want := []string{
+		`rplex: emit *rplex.testToken "one" at byte 0`,
+		`rplex: emit *rplex.testToken "two" at byte 4`,
+		`rplex: emit *rplex.testToken "three" at byte 8`,
+	}
+	if strings.Join(emits, "\n") != strings.Join(want, "\n") {
+		t.Errorf("have trace:\n%s\nwant the tokens in input order", trace.String())
+	}
+}
+
+func TestRunE(t *testing.T) {
+	lexAll := func(l *Lexer) LexFn {
+		l.AcceptRunExcept("")
+		l.Emit(&testToken{})
+		return nil
+	}
+
+	ts, err := New("abc").RunE(lexAll)
+	if err != nil {
+		t.Errorf("have error %s; want nil", err)
+	}
+	if len(ts) != 1 {
+		t.Errorf("have length %d; want 1", len(ts))
+	}
+
+	ts, err = New("ab\xff", WithInvalidRune(InvalidError)).RunE(lexAll)
+	if err == nil {
+		t.Errorf("want non-nil error")
+	}
+	if len(ts) != 1 || ts[0].Text() != "ab" {
+		t.Errorf("want tokens lexed before the error to be returned")
+	}
+}
+
+func TestAcceptDelimitedRun(t *testing.T) {
+	cases := []struct {
+		input   string
+		content string
+		ok      bool
+		pos     int
+	}{
+		{"*italic* rest", "italic", true, 8},
+		{"**bold** rest", "bold", true, 8},
+		{"**a *b* c** rest", "a *b* c", true, 11},
+		{"`code` rest", "", false, 0},
+		{"**unterminated*", "", false, 0},
+	}
+
+	for _, c := range cases {
+		l := New(c.input)
+		content, ok := l.AcceptDelimitedRun('*')
+
+		if content != c.content || ok != c.ok {
+			t.Errorf("have (%s, %t) for '%s'; want (%s, %t)", content, ok, c.input, c.content, c.ok)
+		}
+
+		if l.Pos != c.pos {
+			t.Errorf("have pos %d for '%s'; want %d", l.Pos, c.input, c.pos)
+		}
+	}
+}
+
+type posToken struct {
+	TextToken
+	start, end int
+}
+
+func (t *posToken) SetPos(start, end int) {
+	t.start, t.end = start, end
+}
+
+func (t *posToken) Pos() (int, int) {
+	return t.start, t.end
+}
+
+func TestSubLexer(t *testing.T) {
+	input := `say "hello world" twice`
+	l := New(input)
+
+	l.AcceptUntil(`"`)
+	l.Accept(`"`)
+	start := l.Pos
+	l.AcceptUntil(`"`)
+
+	ts := l.SubLexer(start, l.Pos).Run(func(l *Lexer) LexFn {
+		for {
+			l.AcceptRun(" ")
+			l.Ignore()
+			if l.Peek() == EOF {
+				return nil
+			}
+			l.AcceptRunFunc(unicode.IsLetter)
+			l.Emit(&posToken{})
+		}
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	for _, tok := range ts {
+		s, e := tok.(PosToken).Pos()
+		if input[s:e] != tok.Text() {
+			t.Errorf("have text '%s' at %d:%d; want '%s'", input[s:e], s, e, tok.Text())
+		}
+	}
+
+	sub := l.SubLexer(start, l.Pos).SubLexer(6, 11)
+	sub.AcceptRunFunc(unicode.IsLetter)
+	sub.Emit(&posToken{})
+
+	if s, _ := sub.Tokens[0].(PosToken).Pos(); s != 11 {
+		t.Errorf("have nested start %d; want 11", s)
+	}
+}
+
+func TestSubLexerHooks(t *testing.T) {
+	l := New("a b c")
+	l.OnEmit(func(t Token) Token {
+		t.SetText(strings.ToUpper(t.Text()))
+		return t
+	})
+
+	ts := l.RunParallel(func(s string) []string {
+		return strings.SplitAfter(s, " ")
+	}, lexBenchWords, 2)
+
+	var have []string
+	for _, tok := range ts {
+		have = append(have, tok.Text())
+	}
+	if strings.Join(have, " ") != "A B C" {
+		t.Errorf("have tokens %q; want the hooks to be run for every chunk", have)
+	}
+}
+
+func TestAcceptRunFuncUnescaped(t *testing.T) {
+	l := New(`my\ file.txt other`)
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptRunFuncUnescaped(func(r rune) bool {
+			return !unicode.IsSpace(r)
+		}, '\\')
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 1 {
+		t.Fatalf("have length %d; want 1", len(ts))
+	}
+
+	if ts[0].Text() != `my\ file.txt` {
+		t.Errorf(`have text '%s'; want 'my\ file.txt'`, ts[0].Text())
+	}
+}
+
+func TestEmitRange(t *testing.T) {
+	l := New("key = value")
+	l.AcceptRunExcept("")
+
+	if !l.EmitRange(&posToken{}, 6, 11) {
+		t.Fatalf("want valid range to be emitted")
+	}
+
+	if l.EmitRange(&posToken{}, 6, 12) || l.EmitRange(&posToken{}, 4, 3) {
+		t.Errorf("want invalid ranges not to be emitted")
+	}
+
+	if len(l.Tokens) != 1 {
+		t.Fatalf("have length %d; want 1", len(l.Tokens))
+	}
+
+	if l.Tokens[0].Text() != "value" {
+		t.Errorf("have text '%s'; want 'value'", l.Tokens[0].Text())
+	}
+
+	if s, e := l.Tokens[0].(PosToken).Pos(); s != 6 || e != 11 {
+		t.Errorf("have pos %d:%d; want 6:11", s, e)
+	}
+
+	if l.Pos != 11 || l.TokenStart != 0 {
+		t.Errorf("have pos %d and token start %d; want 11 and 0", l.Pos, l.TokenStart)
+	}
+}
+
+func TestCountPending(t *testing.T) {
+	l := New("x 1.2.3")
+	l.Accept("x ")
+	l.Accept(" ")
+	l.Ignore()
+
+	l.AcceptRun("0123456789.")
+
+	if n := l.CountPending('.'); n != 2 {
+		t.Errorf("have count %d; want 2", n)
+	}
+
+	if n := l.CountPending('x'); n != 0 {
+		t.Errorf("have count %d; want 0", n)
+	}
+}
+
+func TestPending(t *testing.T) {
+	l := New("if x")
+
+	if p := l.Pending(); p != "" {
+		t.Errorf("have pending '%s'; want ''", p)
+	}
+
+	l.AcceptIdentifier()
+	if p := l.Pending(); p != "if" {
+		t.Errorf("have pending '%s'; want 'if'", p)
+	}
+
+	l.Emit(&testToken{})
+	if p := l.Pending(); p != "" {
+		t.Errorf("have pending '%s' after Emit; want ''", p)
+	}
+}
+
+func TestEmitText(t *testing.T) {
+	l := New("SELECT x")
+	l.AcceptIdentifier()
+	l.EmitText(&posToken{}, strings.ToLower(l.Pending()))
+
+	if l.TokenStart != 6 {
+		t.Errorf("have token start %d; want 6", l.TokenStart)
+	}
+
+	tok := l.Tokens[0].(*posToken)
+	if tok.Text() != "select" {
+		t.Errorf("have text '%s'; want 'select'", tok.Text())
+	}
+
+	if tok.start != 0 || tok.end != 6 {
+		t.Errorf("have pos (%d, %d); want (0, 6)", tok.start, tok.end)
+	}
+}
+
+func TestEmitNonEmpty(t *testing.T) {
+	ts := New(",a,,b").Run(func(l *Lexer) LexFn {
+		for !l.AtEOF() {
+			l.AcceptRunExcept(",")
+			l.EmitNonEmpty(&testToken{})
+			l.Accept(",")
+			l.Ignore()
+		}
+		return nil
+	})
+
+	if len(ts) != 2 || ts[0].Text() != "a" || ts[1].Text() != "b" {
+		t.Errorf("have tokens %v; want 'a' and 'b' only", ts)
+	}
+
+	if New("").EmitNonEmpty(&testToken{}) {
+		t.Errorf("want false for an empty token")
+	}
+}
+
+func TestRunInto(t *testing.T) {
+	dst := make([]Token, 0, 4)
+	dst = append(dst, &testToken{})
+
+	ts := New("a b").RunInto(dst, func(l *Lexer) LexFn {
+		l.Accept("a")
+		l.Emit(&testToken{})
+		l.SkipSpaces()
+		l.Accept("b")
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 3 {
+		t.Fatalf("have length %d; want 3", len(ts))
+	}
+
+	if &ts[0] != &dst[0] {
+		t.Errorf("want dst's backing array to be reused")
+	}
+
+	if ts[2].Text() != "b" {
+		t.Errorf("have text '%s'; want 'b'", ts[2].Text())
+	}
+}
+
+var benchInputs = []string{"one two", "three four five", "six", "seven eight"}
+
+func lexBenchWords(l *Lexer) LexFn {
+	for {
+		l.SkipSpaces()
+		if l.Peek() == EOF {
+			return nil
+		}
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.Emit(&testToken{})
+	}
+}
+
+// lexWordsWith returns a LexFn that lexes one run of
+// non-space runes with each call, emitting it with emit
+func lexWordsWith(emit func(*Lexer)) LexFn {
+	var lexWord LexFn
+	lexWord = func(l *Lexer) LexFn {
+		l.SkipSpaces()
+		if l.Peek() == EOF {
+			return nil
+		}
+		l.AcceptRunExcept(" \t\r\n")
+		emit(l)
+		return lexWord
+	}
+	return lexWord
+}
+
+func BenchmarkRun(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, in := range benchInputs {
+			New(in).Run(lexBenchWords)
+		}
+	}
+}
+
+func BenchmarkNext(b *testing.B) {
+	input := strings.Repeat("lorem ipsum dolor sit amet\n", 1000)
+	b.SetBytes(int64(len(input)))
+	b.ReportAllocs()
+	l := New("")
+	for i := 0; i < b.N; i++ {
+		l.Reset(input)
+		for l.Next() != EOF {
+		}
+	}
+}
+
+func BenchmarkRunInto(b *testing.B) {
+	b.ReportAllocs()
+	dst := make([]Token, 0, 8)
+	for i := 0; i < b.N; i++ {
+		for _, in := range benchInputs {
+			dst = New(in).RunInto(dst[:0], lexBenchWords)
+		}
+	}
+}
+
+func BenchmarkRunReset(b *testing.B) {
+	b.ReportAllocs()
+	l := New("")
+	for i := 0; i < b.N; i++ {
+		for _, in := range benchInputs {
+			l.Reset(in)
+			l.Run(lexBenchWords)
+		}
+	}
+}
+
+func TestWithNormalization(t *testing.T) {
+	// A stand-in for norm.NFC.String that only knows about é
+	nfc := strings.NewReplacer("e\u0301", "\u00e9").Replace
+
+	for _, in := range []string{"caf\u00e9 x", "cafe\u0301 x"} {
+		l := New(in, WithNormalization(nfc))
+		ts := l.Run(lexBenchWords)
+
+		if ts[0].Text() != "caf\u00e9" {
+			t.Errorf("have text %q for %q; want %q", ts[0].Text(), in, "caf\u00e9")
+		}
+
+		l.Reset("e\u0301")
+		if l.Text != "\u00e9" {
+			t.Errorf("have text %q after Reset; want it normalized", l.Text)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	l := New("one\ntwo", WithEOFToken(func() Token {
+		return &eofToken{}
+	}))
+	l.Run(lexBenchWords)
+	l.Diag(SeverityInfo, "done")
+
+	l.Reset("three")
+	if l.Pos != 0 || l.TokenStart != 0 || l.Line != 1 || l.Column != 1 {
+		t.Errorf("have pos %d, start %d at %s; want 0, 0 at 1:1", l.Pos, l.TokenStart, l.Position())
+	}
+
+	if len(l.Tokens) != 0 || len(l.Diagnostics()) != 0 {
+		t.Errorf("have %d tokens and %d diagnostics; want none", len(l.Tokens), len(l.Diagnostics()))
+	}
+
+	ts := l.Run(lexBenchWords)
+	if len(ts) != 2 || ts[0].Text() != "three" {
+		t.Fatalf("have tokens %v; want 'three' and EOF", ts)
+	}
+
+	if _, ok := ts[1].(*eofToken); !ok {
+		t.Errorf("have %T; want the EOF token option to be kept", ts[1])
+	}
+}
+
+func TestWithRuneDecoder(t *testing.T) {
+	latin1 := func(s string) (rune, int) {
+		if len(s) == 0 {
+			return utf8.RuneError, 0
+		}
+		return rune(s[0]), 1
+	}
+
+	l := New("caf\xe9 \xbfqu\xe9?", WithRuneDecoder(latin1))
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.Emit(&testToken{})
+		l.SkipSpaces()
+		l.Accept("¿")
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	if ts[0].Text() != "caf\xe9" {
+		t.Errorf("have text '%q'; want 'caf\\xe9'", ts[0].Text())
+	}
+
+	if ts[1].Text() != "\xbfqu\xe9" {
+		t.Errorf("have text '%q'; want '\\xbfqu\\xe9'", ts[1].Text())
+	}
+}
+
+func TestAcceptIf(t *testing.T) {
+	l := New("+1")
+
+	r, ok := l.AcceptIf(func(r rune) bool {
+		return r == '+' || r == '-'
+	})
+	if !ok || r != '+' {
+		t.Errorf("have (%q, %t); want ('+', true)", r, ok)
+	}
+
+	r, ok = l.AcceptIf(unicode.IsLetter)
+	if ok || r != utf8.RuneError {
+		t.Errorf("have (%q, %t); want (RuneError, false)", r, ok)
+	}
+
+	if l.Pos != 1 {
+		t.Errorf("have pos %d; want 1", l.Pos)
+	}
+}
+
+func TestAcceptIdentifier(t *testing.T) {
+	cases := []struct {
+		input string
+		ok    bool
+		text  string
+	}{
+		{"foo_bar2 x", true, "foo_bar2"},
+		{"_x", true, "_x"},
+		{"héllo!", true, "héllo"},
+		{"2x", false, ""},
+		{"", false, ""},
+	}
+
+	for _, c := range cases {
+		l := New(c.input)
+		ok := l.AcceptIdentifier()
+		if ok != c.ok || l.Text[:l.Pos] != c.text {
+			t.Errorf("have (%t, '%s') for '%s'; want (%t, '%s')", ok, l.Text[:l.Pos], c.input, c.ok, c.text)
+		}
+	}
+
+	l := New("font-size: 1em")
+	l.AcceptIdentifierFunc(func(r rune) bool {
+		return r == '-' || IsIdentContinue(r)
+	})
+	if l.Text[:l.Pos] != "font-size" {
+		t.Errorf("have '%s'; want 'font-size'", l.Text[:l.Pos])
+	}
+}
+
+func TestEmitAndDispatch(t *testing.T) {
+	var states []string
+	var lexKeyword LexFn
+	record := func(name string) LexFn {
+		return func(l *Lexer) LexFn {
+			states = append(states, name)
+			return lexKeyword
+		}
+	}
+
+	table := map[string]LexFn{
+		"if":  record("if"),
+		"for": record("for"),
+	}
+	def := record("default")
+
+	lexKeyword = func(l *Lexer) LexFn {
+		l.SkipSpaces()
+		if l.Peek() == EOF {
+			return nil
+		}
+		l.AcceptRunFunc(unicode.IsLetter)
+		return l.EmitAndDispatch(&testToken{}, table, def)
+	}
+
+	New("for x if").Run(lexKeyword)
+
+	want := []string{"for", "default", "if"}
+	if strings.Join(states, ",") != strings.Join(want, ",") {
+		t.Errorf("have states %v; want %v", states, want)
+	}
+}
+
+func TestAcceptOperator(t *testing.T) {
+	ops := []string{"<", "<=", "<=>", "<<", "<<=", "=", "==", "!", "!=", "&&", "&"}
+
+	input := "<=><<=<<<!=!a"
+	want := []string{"<=>", "<<=", "<<", "<", "!=", "!"}
+
+	for _, l := range []*Lexer{New(input), NewReader(iotest.OneByteReader(strings.NewReader(input)))} {
+		var have []string
+		for {
+			op, ok := l.AcceptOperator(ops)
+			if !ok {
+				break
+			}
+			have = append(have, op)
+		}
+
+		if strings.Join(have, " ") != strings.Join(want, " ") {
+			t.Errorf("have operators %v; want %v", have, want)
+		}
+
+		if l.Peek() != 'a' {
+			t.Errorf("have next rune '%c'; want 'a'", l.Peek())
+		}
+	}
+}
+
+func TestTokenStartRune(t *testing.T) {
+	l := New("€100")
+
+	if r := l.TokenStartRune(); r != '€' {
+		t.Errorf("have rune '%c'; want '€'", r)
+	}
+
+	l.AcceptRunExcept("")
+	if r := l.TokenStartRune(); r != '€' {
+		t.Errorf("have rune '%c'; want '€'", r)
+	}
+
+	if l.Pos != len(l.Text) {
+		t.Errorf("have pos %d; want %d", l.Pos, len(l.Text))
+	}
+
+	l.Ignore()
+	if r := l.TokenStartRune(); r != EOF {
+		t.Errorf("have rune '%c'; want EOF", r)
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var lexRune LexFn
+	lexRune = func(l *Lexer) LexFn {
+		l.Next()
+		l.Emit(&testToken{})
+		if len(l.Tokens) == 5 {
+			cancel()
+		}
+		return lexRune
+	}
+
+	ts, err := New(strings.Repeat("a", 100)).RunContext(ctx, lexRune)
+	if err != context.Canceled {
+		t.Errorf("have error %v; want context.Canceled", err)
+	}
+	if len(ts) != 5 {
+		t.Errorf("have length %d; want 5", len(ts))
+	}
+
+	// A LexFn that consumes a lot of input is stopped by the checks in Next
+	ctx, cancel = context.WithCancel(context.Background())
+	_, err = New(strings.Repeat("a", 1e6)).RunContext(ctx, func(l *Lexer) LexFn {
+		cancel()
+		for l.Next() == 'a' {
+		}
+		if l.Pos == len(l.Text) {
+			t.Errorf("want lexing to stop before the end of the input")
+		}
+		return nil
+	})
+	if err != context.Canceled {
+		t.Errorf("have error %v; want context.Canceled", err)
+	}
+
+	// A context that has passed its deadline stops lexing too
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	ts, err = New("abc").RunContext(ctx, lexRune)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("have error %v; want context.DeadlineExceeded", err)
+	}
+	if len(ts) != 0 {
+		t.Errorf("have length %d; want 0", len(ts))
+	}
+}
+
+func TestAcceptRepeated(t *testing.T) {
+	cases := []struct {
+		input    string
+		min, max int
+		want     int
+	}{
+		{"=====x", 3, 3, 3},
+		{"===x", 3, 5, 3},
+		{"====x", 3, 5, 4},
+		{"==x", 3, 5, 0},
+		{"", 1, 5, 0},
+		{"x", 0, 5, 0},
+	}
+
+	for _, c := range cases {
+		l := New(c.input)
+		n := l.AcceptRepeated('=', c.min, c.max)
+
+		if n != c.want {
+			t.Errorf("have count %d for '%s'; want %d", n, c.input, c.want)
+		}
+
+		if l.Pos != c.want {
+			t.Errorf("have pos %d for '%s'; want %d", l.Pos, c.input, c.want)
+		}
+	}
+}
+
+func TestAtLineStart(t *testing.T) {
+	l := New("#a b\n#c")
+
+	if !l.AtLineStart() {
+		t.Errorf("want token at column 0 to be at line start")
+	}
+
+	l.AcceptUntil(" ")
+	l.Accept(" ")
+	l.Ignore()
+	if l.AtLineStart() {
+		t.Errorf("want mid-line token not to be at line start")
+	}
+
+	l.AcceptLine()
+	l.Accept("\n")
+	l.Ignore()
+	if !l.AtLineStart() {
+		t.Errorf("want token after a newline to be at line start")
+	}
+}
+
+func TestAcceptUntilBalanced(t *testing.T) {
+	l := New("f(a, (b + (c)), d) + 1")
+	l.AcceptUntil("(")
+	l.Accept("(")
+
+	args, ok := l.AcceptUntilBalanced('(', ')')
+	if !ok {
+		t.Fatalf("want balanced parens to be found")
+	}
+
+	if args != "a, (b + (c)), d" {
+		t.Errorf("have text '%s'; want 'a, (b + (c)), d'", args)
+	}
+
+	if l.Peek() != ' ' {
+		t.Errorf("have next rune '%c'; want ' '", l.Peek())
+	}
+
+	l = New("f(a, (b)")
+	l.AcceptUntil("(")
+	l.Accept("(")
+
+	if _, ok := l.AcceptUntilBalanced('(', ')'); ok {
+		t.Errorf("want unbalanced parens not to be found")
+	}
+
+	if l.Pos != 2 {
+		t.Errorf("have pos %d; want 2", l.Pos)
+	}
+}
+
+func TestAcceptLineInclusive(t *testing.T) {
+	cases := []struct {
+		input     string
+		inclusive bool
+		want      []string
+	}{
+		{"a\nb\n", true, []string{"a\n", "b\n"}},
+		{"a\nb", true, []string{"a\n", "b"}},
+		{"a\nb\n", false, []string{"a", "b"}},
+		{"a\nb", false, []string{"a", "b"}},
+	}
+
+	for _, c := range cases {
+		ts := New(c.input).Run(func(l *Lexer) LexFn {
+			for l.Peek() != EOF {
+				if c.inclusive {
+					l.AcceptLineInclusive()
+					l.Emit(&testToken{})
+					continue
+				}
+				l.AcceptLine()
+				l.Emit(&testToken{})
+				l.Accept("\n")
+				l.Ignore()
+			}
+			return nil
+		})
+
+		if len(ts) != len(c.want) {
+			t.Fatalf("have length %d for %q; want %d", len(ts), c.input, len(c.want))
+		}
+
+		for i, w := range c.want {
+			if ts[i].Text() != w {
+				t.Errorf("have text %q for %q; want %q", ts[i].Text(), c.input, w)
+			}
+		}
+	}
+}
+
+func TestUnEmit(t *testing.T) {
+	l := New("abc123")
+
+	if _, ok := l.UnEmit(); ok {
+		t.Errorf("want nothing to un-emit before emitting")
+	}
+
+	l.AcceptRun("abc")
+	l.Emit(&testToken{})
+	l.AcceptRun("123")
+
+	tok, ok := l.UnEmit()
+	if !ok {
+		t.Fatalf("want last token to be un-emitted")
+	}
+
+	if tok.Text() != "abc" {
+		t.Errorf("have text '%s'; want 'abc'", tok.Text())
+	}
+
+	if len(l.Tokens) != 0 {
+		t.Errorf("have length %d; want 0", len(l.Tokens))
+	}
+
+	if l.TokenStart != 0 {
+		t.Errorf("have token start %d; want 0", l.TokenStart)
+	}
+
+	if _, ok := l.UnEmit(); ok {
+		t.Errorf("want only one un-emit per emit")
+	}
+
+	l.Emit(&testToken{})
+	if l.Tokens[0].Text() != "abc123" {
+		t.Errorf("have text '%s'; want 'abc123'", l.Tokens[0].Text())
+	}
+
+	// Coalescing after UnEmit extends the token before the removed one
+	l = New("abc")
+	l.Next()
+	l.Emit(&testToken{})
+	l.Next()
+	l.Emit(&testToken{})
+	l.UnEmit()
+	l.Next()
+	l.EmitCoalesce(&testToken{})
+	if len(l.Tokens) != 1 || l.Tokens[0].Text() != "abc" {
+		t.Errorf("have tokens %v; want 'abc'", l.Tokens)
+	}
+}
+
+func TestRuneLen(t *testing.T) {
+	l := New("héllo")
+
+	if n := l.ByteLen(); n != 6 {
+		t.Errorf("have byte length %d; want 6", n)
+	}
+
+	if n := l.RuneLen(); n != 5 {
+		t.Errorf("have rune length %d; want 5", n)
+	}
+
+	l.Append(", wörld")
+
+	if n := l.ByteLen(); n != 14 {
+		t.Errorf("have byte length %d; want 14", n)
+	}
+
+	if n := l.RuneLen(); n != 12 {
+		t.Errorf("have rune length %d; want 12", n)
+	}
+}
+
+func TestAcceptBetween(t *testing.T) {
+	l := New("az{09/")
+
+	if !l.AcceptBetween('a', 'z') || !l.AcceptBetween('a', 'z') {
+		t.Errorf("want 'a' and 'z' to be accepted")
+	}
+
+	if l.AcceptBetween('a', 'z') {
+		t.Errorf("want '{' not to be accepted")
+	}
+	l.Accept("{")
+	l.Ignore()
+
+	l.AcceptRunBetween('0', '9')
+	l.Emit(&testToken{})
+
+	if l.Tokens[0].Text() != "09" {
+		t.Errorf("have text '%s'; want '09'", l.Tokens[0].Text())
+	}
+
+	l.Accept("/")
+	if l.AcceptBetween(0, unicode.MaxRune) {
+		t.Errorf("want EOF not to be accepted")
+	}
+}
+
+func TestRunSafe(t *testing.T) {
+	var lexStuck LexFn
+	lexStuck = func(l *Lexer) LexFn {
+		l.AcceptRun("abc")
+		l.Ignore()
+		return lexStuck
+	}
+
+	_, err := New("abc123").RunSafe(lexStuck, 10)
+	if !errors.Is(err, ErrNoProgress) {
+		t.Errorf("have error %v; want ErrNoProgress", err)
+	}
+
+	// Stalling for fewer than maxStalls LexFns in a row is fine
+	calls := 0
+	var lexOneByOne LexFn
+	lexOneByOne = func(l *Lexer) LexFn {
+		calls++
+		if calls%2 == 0 {
+			return lexOneByOne
+		}
+		if l.Next(); l.Width == 0 {
+			return nil
+		}
+		l.Emit(&testToken{})
+		return lexOneByOne
+	}
+
+	ts, err := New("aabbcc").RunSafe(lexOneByOne, 1)
+	if err != nil {
+		t.Errorf("have error %v; want nil", err)
+	}
+	if len(ts) != 6 {
+		t.Errorf("have length %d; want 6", len(ts))
+	}
+}
+
+func TestWithMaxStalls(t *testing.T) {
+	var lexStuck LexFn
+	lexStuck = func(l *Lexer) LexFn {
+		l.AcceptRun("abc")
+		return lexStuck
+	}
+
+	l := New("abc123", WithMaxStalls(2))
+	l.RegisterState("stuck", lexStuck)
+	ts := l.Run(lexStuck)
+
+	if !errors.Is(l.Err(), ErrNoProgress) || !strings.Contains(l.Err().Error(), "state stuck") {
+		t.Errorf("have error %v; want ErrNoProgress naming the state", l.Err())
+	}
+
+	if len(ts) != 1 {
+		t.Fatalf("have length %d; want 1", len(ts))
+	}
+
+	e, ok := ts[0].(*ErrorToken)
+	if !ok || e.Text() != "abc" || e.Msg != "no progress in state stuck" {
+		t.Errorf("have %T %v; want an ErrorToken for the stuck state", ts[0], ts[0])
+	}
+}
+
+func TestEmitBuffered(t *testing.T) {
+	l := New(`a\nb;`)
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		for {
+			r := l.Next()
+			if r == ';' {
+				l.Backup()
+				break
+			}
+			if r == '\\' && l.Accept("n") {
+				r = '\n'
+			}
+			l.AppendToBuffer(r)
+		}
+
+		if l.BufferString() != "a\nb" {
+			t.Errorf("have buffer %q; want %q", l.BufferString(), "a\nb")
+		}
+		l.EmitBuffered(&posToken{})
+
+		l.Accept(";")
+		l.EmitBuffered(&posToken{})
+		return nil
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	if ts[0].Text() != "a\nb" {
+		t.Errorf("have text %q; want %q", ts[0].Text(), "a\nb")
+	}
+
+	if s, e := ts[0].(PosToken).Pos(); s != 0 || e != 4 {
+		t.Errorf("have pos %d:%d; want 0:4", s, e)
+	}
+
+	if ts[1].Text() != "" {
+		t.Errorf("have text %q; want cleared buffer", ts[1].Text())
+	}
+}
+
+func TestAcceptInt(t *testing.T) {
+	cases := []struct {
+		input string
+		base  int
+		want  int64
+		ok    bool
+		pos   int
+	}{
+		{"ff;", 16, 255, true, 2},
+		{"-42;", 10, -42, true, 3},
+		{"+7", 10, 7, true, 2},
+		{"1012", 2, 5, true, 3},
+		{"-ff", 16, 0, false, 0},
+		{"x", 10, 0, false, 0},
+		{"-", 10, 0, false, 0},
+		{"99999999999999999999", 10, 0, false, 0},
+	}
+
+	for _, c := range cases {
+		l := New(c.input)
+		n, ok := l.AcceptInt(c.base)
+
+		if n != c.want || ok != c.ok {
+			t.Errorf("have (%d, %t) for '%s'; want (%d, %t)", n, ok, c.input, c.want, c.ok)
+		}
+
+		if l.Pos != c.pos {
+			t.Errorf("have pos %d for '%s'; want %d", l.Pos, c.input, c.pos)
+		}
+	}
+}
+
+func TestAcceptFloat(t *testing.T) {
+	cases := []struct {
+		input string
+		want  float64
+		ok    bool
+		pos   int
+	}{
+		{"1.5e3;", 1500, true, 5},
+		{"-2.5E-1", -0.25, true, 7},
+		{".5", 0.5, true, 2},
+		{"3.", 3, true, 2},
+		{"12e+", 12, true, 2},
+		{"-.", 0, false, 0},
+		{"abc", 0, false, 0},
+	}
+
+	for _, c := range cases {
+		l := New(c.input)
+		f, ok := l.AcceptFloat()
+
+		if f != c.want || ok != c.ok {
+			t.Errorf("have (%g, %t) for '%s'; want (%g, %t)", f, ok, c.input, c.want, c.ok)
+		}
+
+		if l.Pos != c.pos {
+			t.Errorf("have pos %d for '%s'; want %d", l.Pos, c.input, c.pos)
+		}
+	}
+}
+
+type lineColToken struct {
+	TextToken
+	line, col int
+}
+
+func (t *lineColToken) SetLineCol(line, col int) {
+	t.line, t.col = line, col
+}
+
+func TestLineColToken(t *testing.T) {
+	l := New("one two\n\nthrée four\n  five")
+
+	ts := l.Run(lexWordsWith(func(l *Lexer) {
+		l.Emit(&lineColToken{})
+	}))
+
+	want := []struct{ line, col int }{
+		{1, 1}, {1, 5}, {3, 1}, {3, 7}, {4, 3},
+	}
+
+	if len(ts) != len(want) {
+		t.Fatalf("have length %d; want %d", len(ts), len(want))
+	}
+
+	for i, w := range want {
+		tok := ts[i].(*lineColToken)
+		if tok.line != w.line || tok.col != w.col {
+			t.Errorf("have %d:%d for '%s'; want %d:%d", tok.line, tok.col, tok.Text(), w.line, w.col)
+		}
+	}
+}
+
+func TestSplice(t *testing.T) {
+	lexWords := lexWordsWith(func(l *Lexer) {
+		l.Emit(&posToken{})
+	})
+
+	l := New("a #include c")
+	l.Run(lexWords)
+
+	included := New("b1 b2").Run(lexWords)
+	l.SpliceWithOffset(2, 100, included)
+	l.Splice(4, []Token{&testToken{}})
+
+	want := []string{"a", "#include", "b1", "b2", "", "c"}
+	if len(l.Tokens) != len(want) {
+		t.Fatalf("have length %d; want %d", len(l.Tokens), len(want))
+	}
+
+	for i, w := range want {
+		if l.Tokens[i].Text() != w {
+			t.Errorf("have text '%s' at %d; want '%s'", l.Tokens[i].Text(), i, w)
+		}
+	}
+
+	if s, e := l.Tokens[3].(PosToken).Pos(); s != 103 || e != 105 {
+		t.Errorf("have pos %d:%d; want 103:105", s, e)
+	}
+}
+
+func TestAcceptWhile(t *testing.T) {
+	l := New("    \t\tfoo")
+
+	if n := l.AcceptWhile(" "); n != 4 {
+		t.Errorf("have count %d; want 4", n)
+	}
+
+	if n := l.AcceptWhileFunc(unicode.IsSpace); n != 2 {
+		t.Errorf("have count %d; want 2", n)
+	}
+
+	if n := l.AcceptWhile(" "); n != 0 {
+		t.Errorf("have count %d; want 0", n)
+	}
+
+	if l.Pos != 6 {
+		t.Errorf("have pos %d; want 6", l.Pos)
+	}
+}
+
+func newTestTokenPool() *sync.Pool {
+	return &sync.Pool{
+		New: func() interface{} {
+			return &testToken{}
+		},
+	}
+}
+
+func emitPooled(l *Lexer) {
+	l.EmitPooled()
+}
+
+func TestEmitPooled(t *testing.T) {
+	pool := newTestTokenPool()
+
+	for _, in := range []string{"one two", "three four"} {
+		l := New(in, WithTokenPool(pool))
+		ts := l.Run(lexWordsWith(emitPooled))
+
+		if strings.Join([]string{ts[0].Text(), ts[1].Text()}, " ") != in {
+			t.Errorf("have tokens '%s' '%s'; want '%s'", ts[0].Text(), ts[1].Text(), in)
+		}
+
+		l.ReleaseTokens(ts)
+		if ts[0] != nil {
+			t.Errorf("want released tokens to be cleared")
+		}
+	}
+}
+
+func TestEmitFrom(t *testing.T) {
+	words := newTestTokenPool()
+	numbers := &sync.Pool{
+		New: func() interface{} {
+			return &posToken{}
+		},
+	}
+
+	ts := New("a 1").Run(func(l *Lexer) LexFn {
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.EmitFrom(words)
+		l.SkipSpaces()
+		l.AcceptRunFunc(unicode.IsDigit)
+		l.EmitFrom(numbers)
+		return nil
+	})
+
+	if _, ok := ts[0].(*testToken); !ok || ts[0].Text() != "a" {
+		t.Errorf("have %T '%s'; want *testToken 'a'", ts[0], ts[0].Text())
+	}
+
+	if _, ok := ts[1].(*posToken); !ok || ts[1].Text() != "1" {
+		t.Errorf("have %T '%s'; want *posToken '1'", ts[1], ts[1].Text())
+	}
+}
+
+var benchWords = strings.Repeat("lorem ipsum dolor sit amet ", 100)
+
+func TestEmitDoesNotCopy(t *testing.T) {
+	l := New(benchWords)
+	tok := &testToken{}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		l.Tokens = l.Tokens[:0]
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.Emit(tok)
+		l.SkipSpaces()
+	})
+
+	if allocs != 0 {
+		t.Errorf("have %.0f allocations per Emit; want 0", allocs)
+	}
+}
+
+func BenchmarkEmit(b *testing.B) {
+	b.ReportAllocs()
+	dst := make([]Token, 0, 1000)
+	for i := 0; i < b.N; i++ {
+		dst = New(benchWords).RunInto(dst[:0], lexBenchWords)
+	}
+}
+
+func BenchmarkEmitPooled(b *testing.B) {
+	b.ReportAllocs()
+	pool := newTestTokenPool()
+	dst := make([]Token, 0, 1000)
+	for i := 0; i < b.N; i++ {
+		l := New(benchWords, WithTokenPool(pool))
+		dst = l.RunInto(dst[:0], lexWordsWith(emitPooled))
+		l.ReleaseTokens(dst)
+	}
+}
+
+func TestAcceptRunStoppingAt(t *testing.T) {
+	l := New("abc.def ghi")
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		l.AcceptRunStoppingAt("abcdefghi.", ".")
+		l.Emit(&testToken{})
+
+		l.AcceptRunStoppingAt("abcdefghi.", "")
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if len(ts) != 2 {
+		t.Fatalf("have length %d; want 2", len(ts))
+	}
+
+	if ts[0].Text() != "abc" {
+		t.Errorf("have text '%s'; want 'abc'", ts[0].Text())
+	}
+
+	if ts[1].Text() != ".def" {
+		t.Errorf("have text '%s'; want '.def'", ts[1].Text())
+	}
+}
+
+func TestOnEmit(t *testing.T) {
+	l := New("one  two three", WithWhitespaceTokens(func() Token {
+		return &posToken{}
+	}))
+
+	var seen int
+	l.OnEmit(func(t Token) Token {
+		seen++
+		if _, ok := t.(*posToken); ok {
+			return nil
+		}
+		return t
+	})
+	l.OnEmit(func(t Token) Token {
+		t.SetText(strings.ToUpper(t.Text()))
+		return t
+	})
+
+	ts := l.Run(lexBenchWords)
+	if seen != 5 {
+		t.Errorf("have %d tokens seen by the first hook; want 5", seen)
+	}
+
+	var have []string
+	for _, tok := range ts {
+		have = append(have, tok.Text())
+	}
+	if strings.Join(have, " ") != "ONE TWO THREE" {
+		t.Errorf("have tokens %q; want ONE TWO THREE", have)
+	}
+
+	l.Reset("four")
+	if ts := l.Run(lexBenchWords); len(ts) != 1 || ts[0].Text() != "FOUR" {
+		t.Errorf("have tokens %v; want the hooks to be kept after Reset", ts)
+	}
+
+	// A dropped token doesn't become part of the last one
+	l = New("a b")
+	l.OnEmit(func(t Token) Token {
+		if _, ok := t.(*posToken); ok {
+			return nil
+		}
+		return t
+	})
+	l.Next()
+	l.Emit(&testToken{})
+	l.Next()
+	l.Emit(&posToken{})
+	l.Next()
+	l.EmitCoalesce(&testToken{})
+	if len(l.Tokens) != 1 || l.Tokens[0].Text() != "a b" {
+		t.Errorf("have tokens %v; want 'a b'", l.Tokens)
+	}
+}
+
+func TestWithDedupeConsecutive(t *testing.T) {
+	sameText := func(a, b Token) bool {
+		return a.Text() == b.Text()
+	}
+
+	lexRunes := func(l *Lexer) LexFn {
+		for l.Next(); l.Width > 0; l.Next() {
+			l.Emit(&testToken{})
+		}
+		return nil
+	}
+
+	ts := New("a  b").Run(lexRunes)
+	if len(ts) != 4 {
+		t.Errorf("have length %d; want 4", len(ts))
+	}
+
+	ts = New("a  b ", WithDedupeConsecutive(sameText)).Run(lexRunes)
+	if len(ts) != 4 {
+		t.Fatalf("have length %d; want 4", len(ts))
+	}
+
+	have := ts[0].Text() + ts[1].Text() + ts[2].Text() + ts[3].Text()
+	if have != "a b " {
+		t.Errorf("have texts '%s'; want 'a b '", have)
+	}
+}
+
+func TestAcceptKeyValue(t *testing.T) {
+	l := New("name=rplex;empty=;novalue;x=1")
+
+	k, v, ok := l.AcceptKeyValue('=', ';')
+	if !ok || k != "name" || v != "rplex" {
+		t.Errorf("have (%s, %s, %t); want (name, rplex, true)", k, v, ok)
+	}
+	l.Accept(";")
+
+	k, v, ok = l.AcceptKeyValue('=', ';')
+	if !ok || k != "empty" || v != "" {
+		t.Errorf("have (%s, %s, %t); want (empty, , true)", k, v, ok)
+	}
+	l.Accept(";")
+
+	pos := l.Pos
+	if _, _, ok = l.AcceptKeyValue('=', ';'); ok {
+		t.Errorf("want pair without a separator to fail")
+	}
+	if l.Pos != pos {
+		t.Errorf("have pos %d; want %d", l.Pos, pos)
+	}
+	l.AcceptUntil(";")
+	l.Accept(";")
+
+	k, v, ok = l.AcceptKeyValue('=', ';')
+	if !ok || k != "x" || v != "1" {
+		t.Errorf("have (%s, %s, %t); want (x, 1, true)", k, v, ok)
+	}
+}
+
+type triviaToken struct {
+	TextToken
+	trivia string
+}
+
+func (t *triviaToken) SetLeadingTrivia(trivia string) {
+	t.trivia = trivia
+}
+
+func TestAttachLeadingTrivia(t *testing.T) {
+	l := New("a  # comment\n  b c")
+
+	ts := l.Run(func(l *Lexer) LexFn {
+		for {
+			l.AcceptRunFunc(unicode.IsSpace)
+			l.AttachLeadingTrivia()
+			if l.Accept("#") {
+				l.AcceptLineInclusive()
+				l.AttachLeadingTrivia()
+				continue
+			}
+			if l.Peek() == EOF {
+				return nil
+			}
+			l.AcceptRunFunc(unicode.IsLetter)
+			l.Emit(&triviaToken{})
+		}
+	})
+
+	want := []struct{ text, trivia string }{
+		{"a", ""},
+		{"b", "  # comment\n  "},
+		{"c", " "},
+	}
+
+	if len(ts) != len(want) {
+		t.Fatalf("have length %d; want %d", len(ts), len(want))
+	}
+
+	for i, w := range want {
+		tok := ts[i].(*triviaToken)
+		if tok.Text() != w.text || tok.trivia != w.trivia {
+			t.Errorf("have (%q, %q); want (%q, %q)", tok.Text(), tok.trivia, w.text, w.trivia)
+		}
+	}
+}
+
+func TestAtEOF(t *testing.T) {
+	l := New("a\xffb")
+
+	if l.AtEOF() {
+		t.Errorf("want AtEOF to be false at the start of the input")
+	}
+
+	if l.AcceptUntil("\n") {
+		t.Errorf("want AcceptUntil to be false with no newline in the input")
+	}
+	l.Emit(&testToken{})
+
+	if len(l.Tokens) != 1 || l.Tokens[0].Text() != "a\xffb" {
+		t.Fatalf("have tokens %v; want AcceptUntil to accept past the invalid byte", l.Tokens)
+	}
+
+	if !l.AtEOF() {
+		t.Errorf("want AtEOF to be true at the end of the input")
+	}
+
+	if r := l.Next(); r != EOF || l.Width != 0 {
+		t.Errorf("have (%q, %d); want (EOF, 0)", r, l.Width)
+	}
+}
+
+func TestPeekOK(t *testing.T) {
+	l := New("a\xff")
+	l.Accept("a")
+
+	r, ok := l.PeekOK()
+	if r != utf8.RuneError || !ok {
+		t.Errorf("have (%q, %t); want (RuneError, true)", r, ok)
+	}
+
+	if l.Pos != 1 {
+		t.Errorf("have pos %d; want 1", l.Pos)
+	}
+
+	l.Next()
+	r, ok = l.PeekOK()
+	if r != EOF || ok {
+		t.Errorf("have (%q, %t); want (EOF, false)", r, ok)
+	}
+
+	if l.Pos != 2 {
+		t.Errorf("have pos %d; want 2", l.Pos)
+	}
+}
+
+func TestLineColumn(t *testing.T) {
+	l := New("ké = v\nk2 = v2\n")
+
+	l.AcceptLine()
+	if p := l.Position(); p.Line != 1 || p.Column != 7 || p.Offset != 7 {
+		t.Errorf("have position %d:%d (%d); want 1:7 (7)", p.Line, p.Column, p.Offset)
+	}
+
+	l.Next()
+	if p := l.Position().String(); p != "2:1" {
+		t.Errorf("have position %s; want 2:1", p)
+	}
+
+	l.Backup()
+	if p := l.Position().String(); p != "1:7" {
+		t.Errorf("have position %s after Backup; want 1:7", p)
+	}
+
+	l.Next()
+	l.AcceptUntil("=")
+	if p := l.Position().String(); p != "2:4" {
+		t.Errorf("have position %s; want 2:4", p)
+	}
+
+	l.AcceptRepeated('=', 2, 2)
+	if p := l.Position().String(); p != "2:4" {
+		t.Errorf("have position %s after a rollback; want 2:4", p)
+	}
+
+	l.AcceptRunExcept("")
+	if p := l.Position().String(); p != "3:1" {
+		t.Errorf("have position %s at EOF; want 3:1", p)
+	}
+}
+
+type positionedToken struct {
+	TextToken
+	PositionedToken
+}
+
+func emitPositioned(l *Lexer) {
+	l.Emit(&positionedToken{})
+}
+
+func TestPositionedToken(t *testing.T) {
+	input := "foo  bar\nbaz"
+	l := New(input)
+
+	ts := l.Run(lexWordsWith(emitPositioned))
+
+	want := [][2]int{{0, 3}, {5, 8}, {9, 12}}
+	if len(ts) != len(want) {
+		t.Fatalf("have length %d; want %d", len(ts), len(want))
+	}
+
+	for i, w := range want {
+		s, e := ts[i].(PosToken).Pos()
+		if s != w[0] || e != w[1] {
+			t.Errorf("have pos %d:%d for '%s'; want %d:%d", s, e, ts[i].Text(), w[0], w[1])
+		}
+		if input[s:e] != ts[i].Text() {
+			t.Errorf("have input '%s' at %d:%d; want '%s'", input[s:e], s, e, ts[i].Text())
+		}
+	}
+}
+
+func TestNewReader(t *testing.T) {
+	input := strings.Repeat("one twö <= three\n", 1000)
+
+	lexWords := lexWordsWith(emitPositioned)
+
+	want := New(input).Run(lexWords)
+
+	l := NewReader(iotest.OneByteReader(strings.NewReader(input)))
+	have, err := l.RunE(lexWords)
+	if err != nil {
+		t.Fatalf("have error %s; want nil", err)
+	}
+
+	if len(have) != len(want) {
+		t.Fatalf("have length %d; want %d", len(have), len(want))
+	}
+
+	for i := range want {
+		hs, he := have[i].(PosToken).Pos()
+		ws, we := want[i].(PosToken).Pos()
+		if have[i].Text() != want[i].Text() || hs != ws || he != we {
+			t.Fatalf("have '%s' at %d:%d; want '%s' at %d:%d", have[i].Text(), hs, he, want[i].Text(), ws, we)
+		}
+	}
+}
+
+func TestNewReaderError(t *testing.T) {
+	r := io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(iotest.ErrTimeout))
+
+	ts, err := NewReader(r).RunE(func(l *Lexer) LexFn {
+		l.AcceptRunFunc(unicode.IsLetter)
+		l.Emit(&testToken{})
+		return nil
+	})
+
+	if err != iotest.ErrTimeout {
+		t.Errorf("have error %v; want iotest.ErrTimeout", err)
+	}
+
+	if len(ts) != 1 || ts[0].Text() != "abc" {
+		t.Errorf("want input read before the error to be lexed")
+	}
+}
+
+func emitTest(l *Lexer) {
+	l.Emit(&testToken{})
+}
+
+func TestRunChan(t *testing.T) {
+	lexWord := lexWordsWith(emitTest)
+
+	l := New("one two three", WithEOFToken(func() Token {
+		return &eofToken{}
+	}))
+
+	var have []Token
+	for tok := range l.RunChan(lexWord) {
+		have = append(have, tok)
+	}
+
+	if len(have) != 4 {
+		t.Fatalf("have length %d; want 4", len(have))
+	}
+
+	for i, want := range []string{"one", "two", "three"} {
+		if have[i].Text() != want {
+			t.Errorf("have text '%s'; want '%s'", have[i].Text(), want)
+		}
+	}
+
+	if _, ok := have[3].(*eofToken); !ok {
+		t.Errorf("want EOF token last; have %T", have[3])
+	}
+
+	if len(l.Tokens) != 0 {
+		t.Errorf("have %d unsent tokens; want 0", len(l.Tokens))
+	}
+}
+
+func TestNextToken(t *testing.T) {
+	emitted := 0
+	lexWord := lexWordsWith(func(l *Lexer) {
+		emitted++
+		emitTest(l)
+	})
+
+	l := New("one two three four")
+
+	tok := l.NextToken(lexWord)
+	if tok == nil || tok.Text() != "one" {
+		t.Fatalf("have token %v; want 'one'", tok)
+	}
+
+	// The first token is held back until the second is emitted
+	if emitted != 2 {
+		t.Errorf("have %d tokens emitted; want 2", emitted)
+	}
+
+	var have []string
+	for tok := l.NextToken(lexWord); tok != nil; tok = l.NextToken(lexWord) {
+		have = append(have, tok.Text())
+	}
+
+	if strings.Join(have, " ") != "two three four" {
+		t.Errorf("have tokens %v; want [two three four]", have)
+	}
+
+	if l.NextToken(lexWord) != nil {
+		t.Errorf("want nil token after lexing has finished")
+	}
+}
+
+func TestAll(t *testing.T) {
+	lexWord := lexWordsWith(emitTest)
+
+	l := New("one two three four five")
+
+	var have []string
+	for tok := range l.All(lexWord) {
+		have = append(have, tok.Text())
+		if tok.Text() == "two" {
+			break
+		}
+	}
+
+	if strings.Join(have, " ") != "one two" {
+		t.Errorf("have tokens %v; want [one two]", have)
+	}
+
+	if l.Pos == len(l.Text) {
+		t.Errorf("want lexing to stop when the loop breaks")
+	}
+
+	have = have[:0]
+	for tok := range l.All(lexWord) {
+		have = append(have, tok.Text())
+	}
+
+	if strings.Join(have, " ") != "three four five" {
+		t.Errorf("have tokens %v; want [three four five]", have)
+	}
+}
+
+func TestPeekN(t *testing.T) {
+	l := New("<<=é")
+
+	if have := string(l.PeekN(3)); have != "<<=" {
+		t.Errorf("have '%s'; want '<<='", have)
+	}
+
+	if have := string(l.PeekN(10)); have != "<<=é" {
+		t.Errorf("have '%s'; want '<<=é'", have)
+	}
+
+	if l.Pos != 0 {
+		t.Errorf("have pos %d; want 0", l.Pos)
+	}
+
+	if have := l.PeekN(-1); have != nil {
+		t.Errorf("have %q for a negative n; want nil", have)
+	}
+
+	l = New("a\xffb", WithInvalidRune(InvalidSkip))
+	if have := string(l.PeekN(2)); have != "ab" {
+		t.Errorf("have '%s'; want 'ab'", have)
+	}
+}
+
+func TestBackupN(t *testing.T) {
+	l := New("ab\ncdé<<x")
+
+	l.AcceptUntil("<")
+	l.Accept("<")
+	l.Accept("<")
+
+	// A speculative match for "<<=" fails partway through
+	if l.Accept("=") {
+		t.Fatalf("want '=' not to be accepted")
+	}
+
+	if !l.BackupN(2) {
+		t.Fatalf("want BackupN(2) to succeed")
+	}
+
+	if l.Pos != 7 || l.Cur != 'é' || l.Prev != 'd' {
+		t.Errorf("have pos %d, cur '%c', prev '%c'; want 7, 'é', 'd'", l.Pos, l.Cur, l.Prev)
+	}
+
+	if !l.BackupN(4) {
+		t.Fatalf("want BackupN(4) to succeed")
+	}
+
+	if p := l.Position(); p.Offset != 2 || p.String() != "1:3" {
+		t.Errorf("have position %s (%d); want 1:3 (2)", p, p.Offset)
+	}
+
+	if l.BackupN(3) {
+		t.Errorf("want BackupN to fail beyond the start of the input")
+	}
+
+	// Runes are decoded again, so the whole input can be backed over
+	l = New(strings.Repeat("a", historySize+1))
+	l.AcceptRun("a")
+	if !l.BackupN(historySize+1) || l.Pos != 0 {
+		t.Errorf("have pos %d; want 0", l.Pos)
+	}
+
+	l = New(strings.Repeat("a", historySize+1), WithInvalidRune(InvalidSkip))
+	l.AcceptRun("a")
+	if l.BackupN(historySize + 1) {
+		t.Errorf("want BackupN to fail beyond the remembered runes")
+	}
+	if !l.BackupN(historySize) || l.Pos != 1 {
+		t.Errorf("have pos %d; want 1", l.Pos)
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	l := New("x\n12abc")
+	l.Accept("x")
+	l.Emit(&testToken{})
+	l.Accept("\n")
+	l.Ignore()
+
+	cp := l.Checkpoint()
+
+	// Try lexing a float, then fall back to an int
+	l.AcceptRun("0123456789")
+	l.Emit(&testToken{})
+	if !l.Accept(".") {
+		l.Restore(cp)
+	}
+
+	if len(l.Tokens) != 1 {
+		t.Errorf("have length %d; want 1", len(l.Tokens))
+	}
+
+	if l.Pos != 2 || l.TokenStart != 2 || l.Cur != '\n' || l.Prev != 'x' {
+		t.Errorf("have pos %d, start %d, cur %q, prev %q; want 2, 2, '\\n', 'x'", l.Pos, l.TokenStart, l.Cur, l.Prev)
+	}
+
+	if p := l.Position().String(); p != "2:1" {
+		t.Errorf("have position %s; want 2:1", p)
+	}
+
+	l.AcceptRun("0123456789")
+	l.Emit(&lineColToken{})
+
+	if tok := l.Tokens[1].(*lineColToken); tok.Text() != "12" || tok.line != 2 || tok.col != 1 {
+		t.Errorf("have '%s' at %d:%d; want '12' at 2:1", tok.Text(), tok.line, tok.col)
+	}
+
+	// Coalescing after Restore extends the token from before the Checkpoint
+	l = New("abc")
+	l.Next()
+	l.Emit(&testToken{})
+	cp = l.Checkpoint()
+	l.Next()
+	l.Emit(&testToken{})
+	l.Restore(cp)
+	l.Next()
+	l.Next()
+	l.EmitCoalesce(&testToken{})
+	if len(l.Tokens) != 1 || l.Tokens[0].Text() != "abc" {
+		t.Errorf("have tokens %v; want 'abc'", l.Tokens)
+	}
+}
+
+func TestAcceptString(t *testing.T) {
+	l := New("truefalse nul")
+
+	if !l.AcceptString("true") {
+		t.Errorf("want 'true' to be accepted")
+	}
+
+	if l.AcceptString("falsey") {
+		t.Errorf("want 'falsey' not to be accepted")
+	}
+
+	if !l.AcceptString("false") {
+		t.Errorf("want 'false' to be accepted")
+	}
+
+	l.SkipSpaces()
+	if l.AcceptString("null") {
+		t.Errorf("want 'null' not to be accepted at the end of the input")
+	}
+
+	if l.Pos != 10 {
+		t.Errorf("have pos %d; want 10", l.Pos)
+	}
+}
+
+func TestAcceptStringFold(t *testing.T) {
+	for _, in := range []string{"SELECT *", "select *", "Select *", "SeLeCt *"} {
+		l := New(in)
+		if !l.AcceptStringFold("select") {
+			t.Errorf("want '%s' to match 'select'", in)
+		}
+		l.Emit(&testToken{})
+
+		if l.Tokens[0].Text() != in[:6] {
+			t.Errorf("have text '%s'; want '%s'", l.Tokens[0].Text(), in[:6])
+		}
+	}
+
+	// The Kelvin sign folds to k but is three bytes long
+	l := New("Key")
+	if !l.AcceptStringFold("KEY") || l.Pos != len(l.Text) {
+		t.Errorf("want Kelvin sign to match 'k'; have pos %d", l.Pos)
+	}
+
+	l = New("selec")
+	if l.AcceptStringFold("select") || l.Pos != 0 {
+		t.Errorf("want partial match not to be accepted")
+	}
+}
+
+func TestAcceptAnyOf(t *testing.T) {
+	l := New("interface int")
+
+	w, ok := l.AcceptAnyOf("in", "int", "interface", "inter")
+	if !ok || w != "interface" {
+		t.Errorf("have (%s, %t); want (interface, true)", w, ok)
+	}
+
+	l.SkipSpaces()
+	w, ok = l.AcceptAnyOf("in", "int", "interface", "inter")
+	if !ok || w != "int" {
+		t.Errorf("have (%s, %t); want (int, true)", w, ok)
+	}
+
+	if _, ok := l.AcceptAnyOf("x", "y"); ok {
+		t.Errorf("want no match at the end of the input")
+	}
+}
+
+func TestAcceptRegexp(t *testing.T) {
+	date := regexp.MustCompile(`^\d{4}-\d{2}-\d{2}`)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}(-[0-9a-f]{4}){3}-[0-9a-f]{12}`)
+	input := "2024-01-31 123e4567-e89b-12d3-a456-426614174000 x"
+
+	for _, l := range []*Lexer{New(input), NewReader(iotest.OneByteReader(strings.NewReader(input)))} {
+		if !l.AcceptRegexp(date) {
+			t.Errorf("want date to be accepted")
+		}
+		l.Emit(&testToken{})
+		l.SkipSpaces()
+
+		if l.AcceptRegexp(date) {
+			t.Errorf("want date not to be accepted")
+		}
+
+		if !l.AcceptRegexp(uuid) {
+			t.Errorf("want UUID to be accepted")
+		}
+		l.Emit(&testToken{})
+
+		if len(l.Tokens) != 2 || l.Tokens[1].Text() != "123e4567-e89b-12d3-a456-426614174000" {
+			t.Errorf("have tokens %v", l.Tokens)
+		}
+
+		if l.AcceptRegexp(regexp.MustCompile(`x`)) {
+			t.Errorf("want match after the current position not to be accepted")
+		}
+	}
+}
+
+func TestAcceptUntilString(t *testing.T) {
+	l := New("<!-- a -- b --> c */")
+
+	l.AcceptString("<!--")
+	l.Ignore()
+	if !l.AcceptUntilString("-->") {
+		t.Errorf("want '-->' to be found")
+	}
+	l.Emit(&testToken{})
+
+	if l.Tokens[0].Text() != " a -- b " {
+		t.Errorf("have text '%s'; want ' a -- b '", l.Tokens[0].Text())
+	}
+
+	if l.AcceptUntilString("]]>") {
+		t.Errorf("want ']]>' not to be found")
+	}
+
+	if l.Pos != len(l.Text) {
+		t.Errorf("have pos %d; want %d", l.Pos, len(l.Text))
+	}
+}
+
+func TestAcceptQuoted(t *testing.T) {
+	l := New(`"say \"hi\"" 'x' "open`)
+
+	if !l.AcceptQuoted('"', '"', '\\') {
+		t.Errorf("want quoted string to be accepted")
+	}
+	l.Emit(&testToken{})
+
+	if l.Tokens[0].Text() != `"say \"hi\""` {
+		t.Errorf(`have text '%s'; want '"say \"hi\""'`, l.Tokens[0].Text())
+	}
+
+	l.SkipSpaces()
+	if l.AcceptQuoted('"', '"', '\\') || l.Pos != 13 {
+		t.Errorf("want nothing accepted without an opening quote")
+	}
+
+	if !l.AcceptQuoted('\'', '\'', '\\') {
+		t.Errorf("want single quoted string to be accepted")
+	}
+
+	l.SkipSpaces()
+	if l.AcceptQuoted('"', '"', '\\') {
+		t.Errorf("want unterminated string not to be accepted")
+	}
+
+	if l.Pos != len(l.Text) {
+		t.Errorf("have pos %d; want %d", l.Pos, len(l.Text))
+	}
+}
+
+func TestWithEscapeRune(t *testing.T) {
+	l := New(`50%% off%; more;rest`, WithEscapeRune('%'))
+
+	s := l.AcceptUntilUnescapedStripped(";")
+	if s != "50% off; more" {
+		t.Errorf("have string '%s'; want '50%% off; more'", s)
+	}
+
+	if l.Pos != 15 {
+		t.Errorf("have pos %d; want 15", l.Pos)
+	}
+
+	l = New(`a\;b;`)
+	if !l.AcceptUntilUnescaped(";") || l.Pos != 4 {
+		t.Errorf("want backslash to be the default escape rune")
+	}
+}
+
+func TestAcceptBalanced(t *testing.T) {
+	l := New("${a + ${b}} rest {")
+
+	l.Accept("$")
+	if !l.AcceptBalanced('{', '}') {
+		t.Errorf("want balanced braces to be accepted")
+	}
+	l.Emit(&testToken{})
+
+	if l.Tokens[0].Text() != "${a + ${b}}" {
+		t.Errorf("have text '%s'; want '${a + ${b}}'", l.Tokens[0].Text())
+	}
+
+	if l.AcceptBalanced('{', '}') {
+		t.Errorf("want nothing accepted without an open rune")
+	}
+
+	l.AcceptUntil("{")
+	pos := l.Pos
+	if l.AcceptBalanced('{', '}') || l.Pos != pos {
+		t.Errorf("want unbalanced braces not to be accepted")
+	}
+}
@@ -0,0 +1,69 @@
+package rplex
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrLimit is wrapped by the error that halts lexing when one of
+// the limits set with WithMaxTokens, WithMaxTokenLen or
+// WithMaxInputLen is exceeded
+var ErrLimit = errors.New("rplex: limit exceeded")
+
+// WithMaxTokens limits how many tokens can be emitted to n. Lexing
+// halts with an ErrorToken in place of the first token over the limit
+func WithMaxTokens(n int) Option {
+	return func(l *Lexer) {
+		l.maxTokens = n
+	}
+}
+
+// WithMaxTokenLen limits how long a token can be to n bytes. Lexing
+// halts with an ErrorToken if more than n bytes are emitted as one
+// token, or a LexFn carries on reading once more than n bytes have
+// been accepted without being emitted or ignored
+func WithMaxTokenLen(n int) Option {
+	return func(l *Lexer) {
+		l.maxTokenLen = n
+	}
+}
+
+// WithMaxInputLen limits how long the input can be to n bytes. Lexing
+// halts with an ErrorToken as soon as input longer than that is read.
+// Lexers from NewReader read in chunks, so more than n bytes may
+// have been read by the time the limit is noticed
+func WithMaxInputLen(n int) Option {
+	return func(l *Lexer) {
+		l.maxInputLen = n
+	}
+}
+
+// checkLimits halts lexing if the input
+// or the current token is too long
+func (l *Lexer) checkLimits() {
+	if l.err != nil {
+		return
+	}
+
+	switch {
+	case l.maxInputLen > 0 && len(l.Text)+l.discarded > l.maxInputLen:
+		l.exceeded("input length", l.maxInputLen)
+	case l.maxTokenLen > 0 && l.Pos-l.TokenStart > l.maxTokenLen:
+		l.exceeded("token length", l.maxTokenLen)
+	}
+}
+
+// exceeded halts lexing because a limit was exceeded, adding an
+// ErrorToken for the current token that says which limit it was
+func (l *Lexer) exceeded(what string, limit int) {
+	msg := fmt.Sprintf("%s exceeds the limit of %d", what, limit)
+
+	t := &ErrorToken{Msg: msg}
+	t.SetText(l.Pending())
+	l.setPos(t, l.TokenStart, l.Pos)
+	l.setLineCol(t, l.TokenStart)
+	l.Tokens = append(l.Tokens, t)
+	l.unEmit = -1
+
+	l.err = fmt.Errorf("%w: %s", ErrLimit, msg)
+}
@@ -0,0 +1,143 @@
+package rplex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLimits(t *testing.T) {
+	cases := []struct {
+		name  string
+		input string
+		opt   Option
+		want  []string
+		msg   string
+	}{
+		{"tokens", "a b c d", WithMaxTokens(2), []string{"a", "b", ""}, "token count exceeds the limit of 2"},
+		{"token length", "ab abcdef abc", WithMaxTokenLen(3), []string{"ab", "abcd"}, "token length exceeds the limit of 3"},
+		{"input length", "a b c", WithMaxInputLen(4), []string{""}, "input length exceeds the limit of 4"},
+	}
+
+	for _, c := range cases {
+		l := New(c.input, c.opt)
+		ts := l.Run(lexBenchWords)
+
+		if !errors.Is(l.Err(), ErrLimit) {
+			t.Errorf("%s: have error %v; want ErrLimit", c.name, l.Err())
+		}
+
+		var have []string
+		for _, tok := range ts {
+			have = append(have, tok.Text())
+		}
+		if strings.Join(have, "|") != strings.Join(c.want, "|") {
+			t.Errorf("%s: have tokens %q; want %q", c.name, have, c.want)
+		}
+
+		e, ok := ts[len(ts)-1].(*ErrorToken)
+		if !ok || e.Msg != c.msg {
+			t.Errorf("%s: have last token %T %v; want ErrorToken '%s'", c.name, ts[len(ts)-1], ts[len(ts)-1], c.msg)
+		}
+	}
+
+	// A token can be as long as the limit, and looking past it is fine
+	l := New("abc def", WithMaxTokenLen(3))
+	if ts := l.Run(lexBenchWords); len(ts) != 2 || l.Err() != nil {
+		t.Errorf("have %d tokens and error %v; want 2 and nil", len(ts), l.Err())
+	}
+}
+
+func TestWithMaxTokensUndo(t *testing.T) {
+	l := New("a b c", WithMaxTokens(2))
+	cp := l.Checkpoint()
+	l.Next()
+	l.Emit(&testToken{})
+	l.Next()
+	l.Emit(&testToken{})
+	if err := l.Restore(cp); err != nil {
+		t.Fatalf("have error %v restoring; want nil", err)
+	}
+
+	l.Next()
+	l.Emit(&testToken{})
+	l.UnEmit()
+	l.Emit(&testToken{})
+	l.Next()
+	l.Emit(&testToken{})
+	if l.Err() != nil || len(l.Tokens) != 2 {
+		t.Errorf("have %d tokens and error %v; want 2 and nil", len(l.Tokens), l.Err())
+	}
+
+	// Restoring can't undo the limit being hit
+	cp = l.Checkpoint()
+	l.Next()
+	l.Emit(&testToken{})
+	if err := l.Restore(cp); !errors.Is(err, ErrLimit) {
+		t.Errorf("have error %v restoring after the limit; want ErrLimit", err)
+	}
+	if _, ok := l.LastToken().(*ErrorToken); !ok || len(l.Tokens) != 3 {
+		t.Errorf("have tokens %v; want the ErrorToken to be kept", l.Tokens)
+	}
+}
+
+func TestWithMaxInputLenReader(t *testing.T) {
+	l := NewReader(strings.NewReader(strings.Repeat("a ", 10000)), WithMaxInputLen(100))
+	l.Run(lexBenchWords)
+
+	if !errors.Is(l.Err(), ErrLimit) {
+		t.Errorf("have error %v; want ErrLimit", l.Err())
+	}
+
+	if len(l.Text) >= 20000 {
+		t.Errorf("have %d bytes read; want lexing to halt before the end", len(l.Text))
+	}
+}
+
+func TestWithMaxInputLenWindow(t *testing.T) {
+	l := NewReader(strings.NewReader(strings.Repeat("a ", 10000)), WithWindow(16), WithMaxInputLen(100))
+	l.Run(lexBenchWords)
+
+	if !errors.Is(l.Err(), ErrLimit) {
+		t.Errorf("have error %v; want ErrLimit", l.Err())
+	}
+}
+
+func TestLimitsParallel(t *testing.T) {
+	input := strings.Repeat("ab cd ef\n", 20)
+	lexWords := func(l *Lexer) LexFn {
+		for {
+			l.SkipWhitespace()
+			if l.AtEOF() {
+				return nil
+			}
+			l.AcceptRunFunc(IsASCIILetter)
+			l.Emit(&posToken{})
+		}
+	}
+	lines := func(s string) []string {
+		return strings.SplitAfter(s, "\n")
+	}
+
+	for _, opt := range []Option{WithMaxTokens(5), WithMaxInputLen(10)} {
+		want := New(input, opt)
+		want.Run(lexWords)
+		have := New(input, opt)
+		have.RunParallel(lines, lexWords, 4)
+
+		if !errors.Is(have.Err(), ErrLimit) || have.Err().Error() != want.Err().Error() {
+			t.Errorf("have error %v; want %v", have.Err(), want.Err())
+		}
+
+		if len(have.Tokens) != len(want.Tokens) {
+			t.Fatalf("have %d tokens; want %d", len(have.Tokens), len(want.Tokens))
+		}
+		for i := range want.Tokens {
+			hs, he := have.Tokens[i].(PosToken).Pos()
+			ws, we := want.Tokens[i].(PosToken).Pos()
+			if have.Tokens[i].Text() != want.Tokens[i].Text() || hs != ws || he != we {
+				t.Errorf("have token %q at %d-%d; want %q at %d-%d", have.Tokens[i].Text(), hs, he, want.Tokens[i].Text(), ws, we)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package rplex
+
+// A NumberKind is the kind of numeric literal accepted by AcceptNumber
+type NumberKind int
+
+const (
+	// NumberNone means that no number was accepted
+	NumberNone NumberKind = iota
+
+	// NumberInt is a decimal integer, e.g. 42 or 1_000
+	NumberInt
+
+	// NumberFloat is a decimal number with a fraction or
+	// an exponent, e.g. 3.14, .5 or 1e-9
+	NumberFloat
+
+	// NumberHex is a hexadecimal integer, e.g. 0xff
+	NumberHex
+
+	// NumberOctal is an octal integer, e.g. 0o755
+	NumberOctal
+
+	// NumberBinary is a binary integer, e.g. 0b1010
+	NumberBinary
+)
+
+// AcceptNumber accepts a numeric literal and returns its kind, or
+// NumberNone if there isn't one, in which case nothing is accepted.
+// Digits may be separated by single underscores. Signs are not
+// accepted; they are left to be lexed as operators. A dot is only
+// accepted as part of a number if a digit follows it, so 1. and 1..2
+// both lex 1 as an integer, and an exponent is only accepted if it
+// has digits, so 1e+ lexes 1 as an integer
+func (l *Lexer) AcceptNumber() NumberKind {
+	prefixes := []struct {
+		prefix string
+		fn     RuneCheck
+		kind   NumberKind
+	}{
+		{"0x", IsHexDigit, NumberHex},
+		{"0o", isOctalDigit, NumberOctal},
+		{"0b", isBinaryDigit, NumberBinary},
+	}
+
+	for _, p := range prefixes {
+		cp := l.Checkpoint()
+		if !l.AcceptStringFold(p.prefix) {
+			continue
+		}
+		if l.acceptDigitRun(p.fn) > 0 {
+			return p.kind
+		}
+		l.Restore(cp)
+	}
+
+	cp := l.Checkpoint()
+	kind := NumberInt
+	digits := l.acceptDigitRun(IsASCIIDigit)
+
+	if next := l.PeekN(2); len(next) == 2 && next[0] == '.' && IsASCIIDigit(next[1]) {
+		l.Accept(".")
+		l.acceptDigitRun(IsASCIIDigit)
+		kind = NumberFloat
+	} else if digits == 0 {
+		l.Restore(cp)
+		return NumberNone
+	}
+
+	exp := l.Checkpoint()
+	if l.Accept("eE") {
+		l.Accept("+-")
+		if l.acceptDigitRun(IsASCIIDigit) > 0 {
+			return NumberFloat
+		}
+		l.Restore(exp)
+	}
+	return kind
+}
+
+// acceptDigitRun accepts a run of runes for which fn returns true,
+// allowing single underscores between them, and returns the number
+// of runes accepted that weren't underscores
+func (l *Lexer) acceptDigitRun(fn RuneCheck) int {
+	n := l.AcceptWhileFunc(fn)
+	for n > 0 {
+		next := l.PeekN(2)
+		if len(next) < 2 || next[0] != '_' || !fn(next[1]) {
+			break
+		}
+		l.Accept("_")
+		n += l.AcceptWhileFunc(fn)
+	}
+	return n
+}
+
+func isOctalDigit(r rune) bool {
+	return '0' <= r && r <= '7'
+}
+
+func isBinaryDigit(r rune) bool {
+	return r == '0' || r == '1'
+}
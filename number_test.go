@@ -0,0 +1,44 @@
+package rplex
+
+import "testing"
+
+func TestAcceptNumber(t *testing.T) {
+	cases := []struct {
+		input string
+		kind  NumberKind
+		text  string
+	}{
+		{"42;", NumberInt, "42"},
+		{"1_000_000", NumberInt, "1_000_000"},
+		{"1__0", NumberInt, "1"},
+		{"1_", NumberInt, "1"},
+		{"3.14", NumberFloat, "3.14"},
+		{".5", NumberFloat, ".5"},
+		{"1.", NumberInt, "1"},
+		{"1..2", NumberInt, "1"},
+		{"1.foo", NumberInt, "1"},
+		{"1e9", NumberFloat, "1e9"},
+		{"2.5E-3", NumberFloat, "2.5E-3"},
+		{"1e+", NumberInt, "1"},
+		{"1ex", NumberInt, "1"},
+		{"0xFF_ff", NumberHex, "0xFF_ff"},
+		{"0XaB", NumberHex, "0XaB"},
+		{"0x", NumberInt, "0"},
+		{"0o755", NumberOctal, "0o755"},
+		{"0o8", NumberInt, "0"},
+		{"0b1010", NumberBinary, "0b1010"},
+		{".", NumberNone, ""},
+		{"x1", NumberNone, ""},
+		{"", NumberNone, ""},
+	}
+
+	for _, c := range cases {
+		l := New(c.input)
+		kind := l.AcceptNumber()
+		l.Emit(&testToken{})
+
+		if kind != c.kind || l.Tokens[0].Text() != c.text {
+			t.Errorf("have (%d, '%s') for '%s'; want (%d, '%s')", kind, l.Tokens[0].Text(), c.input, c.kind, c.text)
+		}
+	}
+}
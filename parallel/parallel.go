@@ -0,0 +1,47 @@
+// Package parallel lexes large inputs, such as logs, using several
+// goroutines at once
+package parallel
+
+import (
+	"strings"
+
+	"github.com/tomnomnom/rplex"
+)
+
+// Lex splits text into chunks with the split function and lexes them
+// concurrently with the specified number of workers, or one per CPU if
+// workers is less than 1. Each chunk is lexed by its own Lexer created
+// with opts, so the split function must only split the input where
+// initial can safely start again. The tokens from all chunks are
+// returned in input order, and the positions of any PosTokens are
+// byte offsets into text rather than into the chunks. If lexing a
+// chunk halts with an error, the tokens up to it are returned along
+// with the error. Use Lexer.RunParallel to get diagnostics as well
+func Lex(text string, split func(string) []string, initial rplex.LexFn, workers int, opts ...rplex.Option) ([]rplex.Token, error) {
+	l := rplex.New(text, opts...)
+	ts := l.RunParallel(split, initial, workers)
+	return ts, l.Err()
+}
+
+// Lines returns a split function for Lex that splits the input into
+// chunks of at least size bytes that end with a newline, except for
+// the last chunk which ends with the input. Grouping lines keeps the
+// cost of starting a Lexer for each chunk down
+func Lines(size int) func(string) []string {
+	return func(text string) []string {
+		var chunks []string
+		for len(text) > size {
+			i := strings.IndexByte(text[size:], '\n')
+			if i < 0 {
+				break
+			}
+			end := size + i + 1
+			chunks = append(chunks, text[:end])
+			text = text[end:]
+		}
+		if text != "" {
+			chunks = append(chunks, text)
+		}
+		return chunks
+	}
+}
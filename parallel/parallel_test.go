@@ -0,0 +1,92 @@
+package parallel
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tomnomnom/rplex"
+)
+
+type field struct {
+	rplex.TextToken
+	rplex.PositionedToken
+}
+
+func lexFields(l *rplex.Lexer) rplex.LexFn {
+	for {
+		l.SkipSpaces()
+		if l.AtEOF() {
+			return nil
+		}
+		l.AcceptRunFunc(func(r rune) bool {
+			return r != ' ' && r != '\n'
+		})
+		l.Emit(&field{})
+	}
+}
+
+func TestLex(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&b, "%d GET /page/%d 200\n", i, i)
+	}
+	input := b.String()
+
+	want := rplex.New(input).Run(lexFields)
+	have, err := Lex(input, Lines(256), lexFields, 4)
+	if err != nil {
+		t.Errorf("have error %v; want nil", err)
+	}
+
+	if len(have) != len(want) {
+		t.Fatalf("have %d tokens; want %d", len(have), len(want))
+	}
+
+	for i := range want {
+		hs, he := have[i].(*field).Pos()
+		ws, we := want[i].(*field).Pos()
+		if have[i].Text() != want[i].Text() || hs != ws || he != we {
+			t.Fatalf("have token %d %q at %d-%d; want %q at %d-%d", i, have[i].Text(), hs, he, want[i].Text(), ws, we)
+		}
+	}
+}
+
+func TestLexError(t *testing.T) {
+	ts, err := Lex("a\nb\xff\nc\n", Lines(0), lexFields, 2, rplex.WithInvalidRune(rplex.InvalidError))
+	if err == nil || err.Error() != "rplex: invalid UTF-8 at byte 3" {
+		t.Errorf("have error %v; want invalid UTF-8 at byte 3", err)
+	}
+	if len(ts) != 2 {
+		t.Errorf("have tokens %v; want 'a' and 'b'", ts)
+	}
+}
+
+func TestLines(t *testing.T) {
+	cases := []struct {
+		input string
+		size  int
+		want  []string
+	}{
+		{"a\nb\nc\n", 3, []string{"a\nb\n", "c\n"}},
+		{"a\nb\nc\n", 0, []string{"a\n", "b\n", "c\n"}},
+		{"aaaa\nb", 2, []string{"aaaa\n", "b"}},
+		{"abc", 1, []string{"abc"}},
+		{"", 1, nil},
+	}
+
+	for _, c := range cases {
+		have := Lines(c.size)(c.input)
+		if strings.Join(have, "|") != strings.Join(c.want, "|") || len(have) != len(c.want) {
+			t.Errorf("have chunks %q for %q; want %q", have, c.input, c.want)
+		}
+	}
+}
+
+func BenchmarkLex(b *testing.B) {
+	input := strings.Repeat("127.0.0.1 GET /index.html 200 1234\n", 10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Lex(input, Lines(64*1024), lexFields, 0)
+	}
+}
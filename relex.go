@@ -0,0 +1,125 @@
+package rplex
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrBadEdit is returned by Relex when an Edit
+// refers to bytes outside of the input
+var ErrBadEdit = errors.New("rplex: edit is outside of the input")
+
+// An Edit is a change to the input of a Lexer
+type Edit struct {
+	Offset   int    // The byte offset the change starts at
+	Deleted  int    // How many bytes were removed from there
+	Inserted string // The text that was inserted there
+}
+
+// Relex applies an edit to the input and updates the tokens from
+// a previous run of the Lexer to match, lexing as little of the
+// new input as it can. It starts lexing again with initial at the
+// end of the last token before the edit, and stops once it emits
+// a token after the edit that has the same text as an old token
+// at the same place, reusing the old tokens from there on with
+// their positions moved. The new token slice is returned, or
+// ErrBadEdit if the edit doesn't fit within Text, in which case
+// nothing is changed.
+//
+// For that to work initial must be able to start lexing at the end
+// of any token, and every token must be a PosToken. If any of the
+// old tokens isn't a PosToken the whole of the new input is lexed
+// again instead. Lexing can only stop between LexFns, so the less
+// each LexFn does the less is lexed again. Old tokens that are
+// reused are changed in place
+func (l *Lexer) Relex(edit Edit, initial LexFn) ([]Token, error) {
+	if edit.Offset < 0 || edit.Deleted < 0 || edit.Offset > len(l.Text)-edit.Deleted {
+		return nil, ErrBadEdit
+	}
+
+	old := l.Tokens
+	editEnd := edit.Offset + edit.Deleted
+	delta := len(edit.Inserted) - edit.Deleted
+	l.Text = l.Text[:edit.Offset] + edit.Inserted + l.Text[editEnd:]
+
+	starts := make([]int, len(old))
+	ends := make([]int, len(old))
+	for i, t := range old {
+		pt, ok := t.(PosToken)
+		if !ok {
+			l.Reset(l.Text)
+			return l.Run(initial), nil
+		}
+		starts[i], ends[i] = pt.Pos()
+		starts[i] -= l.Offset
+		ends[i] -= l.Offset
+	}
+
+	// Tokens that end before the edit can't have been changed by it
+	keep := sort.Search(len(old), func(i int) bool {
+		return ends[i] >= edit.Offset
+	})
+	restart := 0
+	if keep > 0 {
+		restart = ends[keep-1]
+	}
+
+	c := New(l.Text[restart:], l.opts...)
+	c.Offset = restart + l.Offset
+	c.eof = nil
+	c.hooks = l.hooks
+	c.Line, c.Column = l.lineColAt(restart)
+	c.base = lineCol{0, c.Line, c.Column}
+
+	// The first old token that starts after the edit
+	// is the first that the new tokens can match up with
+	next := sort.SearchInts(starts, editEnd)
+	newEnd := edit.Offset + len(edit.Inserted)
+
+	var fresh, reused []Token
+	for t := c.NextToken(initial); t != nil; t = c.NextToken(initial) {
+		pt, ok := t.(PosToken)
+		if !ok {
+			fresh = append(fresh, t)
+			continue
+		}
+
+		start, _ := pt.Pos()
+		start -= l.Offset
+		for next < len(old) && starts[next]+delta < start {
+			next++
+		}
+
+		if start >= newEnd && next < len(old) && starts[next]+delta == start && old[next].Text() == t.Text() {
+			reused = old[next:]
+			break
+		}
+		fresh = append(fresh, t)
+	}
+	l.err = c.err
+
+	for i, t := range reused {
+		t.(PosToken).SetPos(starts[next+i]+delta+l.Offset, ends[next+i]+delta+l.Offset)
+		l.setLineCol(t, starts[next+i]+delta)
+	}
+
+	ts := make([]Token, 0, keep+len(fresh)+len(reused))
+	ts = append(ts, old[:keep]...)
+	ts = append(ts, fresh...)
+	ts = append(ts, reused...)
+	l.Tokens = ts
+
+	// The EOF token is only reused if the new tokens matched up
+	// with the old ones before the end of the input
+	if reused == nil {
+		l.eofEmitted = false
+		l.emitEOF()
+	}
+
+	l.Pos, l.TokenStart, l.Width = len(l.Text), len(l.Text), 0
+	l.Line, l.Column = l.lineColAt(len(l.Text))
+	l.hist.clear()
+	l.unEmit = -1
+	l.runeLen = -1
+	return l.Tokens, nil
+}
@@ -0,0 +1,149 @@
+package rplex
+
+import (
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+type relexToken struct {
+	PositionedToken
+	lineColToken
+}
+
+// lexRelexWords returns after each token so
+// that Relex can stop once it has matched up
+func lexRelexWords(l *Lexer) LexFn {
+	l.SkipWhitespace()
+	if l.AtEOF() {
+		return nil
+	}
+	if l.AcceptRunFunc(IsIdentContinue) == 0 {
+		l.Next()
+	}
+	l.Emit(&relexToken{})
+	return lexRelexWords
+}
+
+func sameTokens(t *testing.T, have, want []Token) {
+	t.Helper()
+	if len(have) != len(want) {
+		t.Fatalf("have %d tokens; want %d", len(have), len(want))
+	}
+
+	for i := range want {
+		h, w := have[i].(*relexToken), want[i].(*relexToken)
+		hs, he := h.Pos()
+		ws, we := w.Pos()
+		if h.Text() != w.Text() || hs != ws || he != we || h.line != w.line || h.col != w.col {
+			t.Fatalf(
+				"have token %d %q at %d-%d (%d:%d); want %q at %d-%d (%d:%d)",
+				i, h.Text(), hs, he, h.line, h.col, w.Text(), ws, we, w.line, w.col,
+			)
+		}
+	}
+}
+
+func TestRelex(t *testing.T) {
+	input := strings.Repeat("foo = bar(1, 2);\nbaz += qux;\n", 100)
+	l := New(input)
+	l.Run(lexRelexWords)
+
+	emitted := 0
+	l.OnEmit(func(t Token) Token {
+		emitted++
+		return t
+	})
+
+	// Turns 'bar' into 'barn' on the third line
+	offset := 2*len("foo = bar(1, 2);\nbaz += qux;\n") + len("foo = bar")
+	ts, err := l.Relex(Edit{Offset: offset, Inserted: "n"}, lexRelexWords)
+	if err != nil {
+		t.Fatalf("have error %v; want nil", err)
+	}
+
+	sameTokens(t, ts, New(l.Text).Run(lexRelexWords))
+	if emitted > 3 {
+		t.Errorf("have %d tokens lexed again; want no more than 3", emitted)
+	}
+
+	if l.Pos != len(l.Text) || l.Line != 201 {
+		t.Errorf("have pos %d on line %d; want %d on line 201", l.Pos, l.Line, len(l.Text))
+	}
+}
+
+func TestRelexRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	inserts := []string{"", "x", " ", "\n", "a b", "(", "\n\nzz"}
+
+	text := strings.Repeat("one two(three)\n four;\n", 20)
+	l := New(text)
+	l.Run(lexRelexWords)
+
+	for i := 0; i < 200; i++ {
+		offset := rng.Intn(len(l.Text) + 1)
+		deleted := rng.Intn(min(4, len(l.Text)-offset) + 1)
+		edit := Edit{offset, deleted, inserts[rng.Intn(len(inserts))]}
+
+		ts, err := l.Relex(edit, lexRelexWords)
+		if err != nil {
+			t.Fatalf("have error %v for edit %+v; want nil", err, edit)
+		}
+		sameTokens(t, ts, New(l.Text).Run(lexRelexWords))
+	}
+}
+
+func TestRelexEOF(t *testing.T) {
+	eof := func() Token {
+		return &relexToken{}
+	}
+
+	l := New("a b", WithEOFToken(eof))
+	l.Run(lexRelexWords)
+
+	ts, _ := l.Relex(Edit{Offset: 3, Inserted: " c"}, lexRelexWords)
+	sameTokens(t, ts, New("a b c", WithEOFToken(eof)).Run(lexRelexWords))
+
+	ts, _ = l.Relex(Edit{Offset: 0, Inserted: "z "}, lexRelexWords)
+	sameTokens(t, ts, New("z a b c", WithEOFToken(eof)).Run(lexRelexWords))
+}
+
+func TestRelexWithoutPositions(t *testing.T) {
+	l := New("a b")
+	l.Run(lexBenchWords)
+
+	ts, _ := l.Relex(Edit{Offset: 1, Inserted: "a"}, lexBenchWords)
+	if len(ts) != 2 || ts[0].Text() != "aa" || ts[1].Text() != "b" {
+		t.Errorf("have tokens %v; want 'aa' and 'b'", ts)
+	}
+}
+
+func TestRelexBadEdit(t *testing.T) {
+	l := New("foo = bar")
+	want := l.Run(lexRelexWords)
+
+	edits := []Edit{
+		{Offset: 100, Deleted: 2},
+		{Offset: 8, Deleted: 2},
+		{Offset: -1},
+		{Offset: 1, Deleted: -1},
+	}
+	for _, edit := range edits {
+		if _, err := l.Relex(edit, lexRelexWords); !errors.Is(err, ErrBadEdit) {
+			t.Errorf("have error %v for edit %+v; want ErrBadEdit", err, edit)
+		}
+	}
+
+	if l.Text != "foo = bar" {
+		t.Errorf("have text %q after bad edits; want it unchanged", l.Text)
+	}
+	sameTokens(t, l.Tokens, want)
+
+	// An edit can end at the end of the input
+	ts, err := l.Relex(Edit{Offset: 6, Deleted: 3, Inserted: "baz"}, lexRelexWords)
+	if err != nil {
+		t.Fatalf("have error %v; want nil", err)
+	}
+	sameTokens(t, ts, New("foo = baz").Run(lexRelexWords))
+}
@@ -0,0 +1,37 @@
+package rplex
+
+import "unicode"
+
+// IsHexDigit returns true if r is 0-9, a-f or A-F
+func IsHexDigit(r rune) bool {
+	return IsASCIIDigit(r) || ('a' <= r && r <= 'f') || ('A' <= r && r <= 'F')
+}
+
+// IsASCIILetter returns true if r is a-z or A-Z
+func IsASCIILetter(r rune) bool {
+	return ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z')
+}
+
+// IsASCIIDigit returns true if r is 0-9
+func IsASCIIDigit(r rune) bool {
+	return '0' <= r && r <= '9'
+}
+
+// IsIdentStart returns true if r can start an identifier;
+// i.e. if it's a letter or an underscore
+func IsIdentStart(r rune) bool {
+	return r == '_' || unicode.IsLetter(r)
+}
+
+// IsIdentContinue returns true if r can appear after the first
+// rune of an identifier; i.e. if it's a letter, a digit or an
+// underscore
+func IsIdentContinue(r rune) bool {
+	return IsIdentStart(r) || unicode.IsDigit(r)
+}
+
+// IsSpaceNoNewline returns true if r is whitespace other
+// than a newline
+func IsSpaceNoNewline(r rune) bool {
+	return r != '\n' && unicode.IsSpace(r)
+}
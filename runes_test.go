@@ -0,0 +1,38 @@
+package rplex
+
+import (
+	"testing"
+	"unicode/utf8"
+)
+
+func TestRuneChecks(t *testing.T) {
+	cases := []struct {
+		name string
+		fn   RuneCheck
+		yes  string
+		no   string
+	}{
+		{"IsHexDigit", IsHexDigit, "09afAF", "gG/:`@ "},
+		{"IsASCIILetter", IsASCIILetter, "azAZ", "09@[`{é_"},
+		{"IsASCIIDigit", IsASCIIDigit, "0123456789", "/:a٣"},
+		{"IsIdentStart", IsIdentStart, "_aZé", "0-$ "},
+		{"IsIdentContinue", IsIdentContinue, "_aZé09٣", "-$ ."},
+		{"IsSpaceNoNewline", IsSpaceNoNewline, " \t\r\v\f ", "\na_"},
+	}
+
+	for _, c := range cases {
+		for _, r := range c.yes {
+			if !c.fn(r) {
+				t.Errorf("want %s(%q) to be true", c.name, r)
+			}
+		}
+		for _, r := range c.no {
+			if c.fn(r) {
+				t.Errorf("want %s(%q) to be false", c.name, r)
+			}
+		}
+		if c.fn(utf8.RuneError) {
+			t.Errorf("want %s(RuneError) to be false", c.name)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package rplex
+
+// A RuneSet is a set of runes that can be checked more quickly
+// than a string of valid runes. ASCII runes are kept in a bitmap
+// and any others in a map. The zero value is an empty set
+type RuneSet struct {
+	ascii [2]uint64
+	other map[rune]struct{}
+}
+
+// NewRuneSet returns a RuneSet containing the runes in valid
+func NewRuneSet(valid string) RuneSet {
+	var s RuneSet
+	for _, r := range valid {
+		if r < 128 {
+			s.ascii[r/64] |= 1 << (r % 64)
+			continue
+		}
+		if s.other == nil {
+			s.other = make(map[rune]struct{})
+		}
+		s.other[r] = struct{}{}
+	}
+	return s
+}
+
+// Contains returns true if r is in the set. It meets the
+// RuneCheck interface, so it can be used with AcceptFunc etc
+func (s RuneSet) Contains(r rune) bool {
+	if uint32(r) < 128 {
+		return s.ascii[r/64]&(1<<(r%64)) != 0
+	}
+	_, ok := s.other[r]
+	return ok
+}
+
+// AcceptSet moves the pointer if the next rune is in the set
+func (l *Lexer) AcceptSet(s RuneSet) bool {
+	if s.Contains(l.Next()) {
+		return true
+	}
+	l.Backup()
+	return false
+}
+
+// AcceptRunSet continually accepts runes that are in the
+// set and returns how many runes were accepted
+func (l *Lexer) AcceptRunSet(s RuneSet) int {
+	n := 0
+	for s.Contains(l.Next()) {
+		n++
+	}
+	l.Backup()
+	return n
+}
@@ -0,0 +1,65 @@
+package rplex
+
+import "testing"
+
+func TestRuneSet(t *testing.T) {
+	s := NewRuneSet("az_é→")
+
+	for _, r := range "az_é→" {
+		if !s.Contains(r) {
+			t.Errorf("want set to contain '%c'", r)
+		}
+	}
+
+	for _, r := range []rune{'b', 'Z', '@', 0x7f, 'è', EOF, 'a' + 64} {
+		if s.Contains(r) {
+			t.Errorf("want set not to contain %q", r)
+		}
+	}
+
+	var zero RuneSet
+	if zero.Contains('a') {
+		t.Errorf("want zero value set to be empty")
+	}
+}
+
+func TestAcceptRunSet(t *testing.T) {
+	l := New("0xdead_beef!")
+	hex := NewRuneSet("0123456789abcdefABCDEF_")
+
+	if !l.AcceptSet(hex) || l.AcceptSet(hex) {
+		t.Errorf("want only '0' to be accepted")
+	}
+
+	l.Accept("x")
+	if n := l.AcceptRunSet(hex); n != 9 {
+		t.Errorf("have %d runes accepted; want 9", n)
+	}
+
+	if l.Peek() != '!' {
+		t.Errorf("have next rune '%c'; want '!'", l.Peek())
+	}
+}
+
+func BenchmarkAcceptRun(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l := New(benchWords)
+		for l.Peek() != EOF {
+			l.AcceptRun("abcdefghijklmnopqrstuvwxyz")
+			l.Next()
+		}
+	}
+}
+
+func BenchmarkAcceptRunSet(b *testing.B) {
+	b.ReportAllocs()
+	letters := NewRuneSet("abcdefghijklmnopqrstuvwxyz")
+	for i := 0; i < b.N; i++ {
+		l := New(benchWords)
+		for l.Peek() != EOF {
+			l.AcceptRunSet(letters)
+			l.Next()
+		}
+	}
+}
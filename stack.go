@@ -0,0 +1,52 @@
+package rplex
+
+// A Stack is a last-in-first-out stack of values that
+// LexFns can use to share state, e.g. the kinds of the
+// brackets that are currently open
+type Stack[T any] struct {
+	items []T
+}
+
+// Push adds v to the top of the stack
+func (s *Stack[T]) Push(v T) {
+	s.items = append(s.items, v)
+}
+
+// Pop removes the value from the top of the stack and returns
+// it. If the stack is empty the zero value and false are returned
+func (s *Stack[T]) Pop() (T, bool) {
+	v, ok := s.Peek()
+	if ok {
+		s.items = s.items[:len(s.items)-1]
+	}
+	return v, ok
+}
+
+// Peek returns the value from the top of the stack without removing
+// it. If the stack is empty the zero value and false are returned
+func (s *Stack[T]) Peek() (T, bool) {
+	if len(s.items) == 0 {
+		var zero T
+		return zero, false
+	}
+	return s.items[len(s.items)-1], true
+}
+
+// Len returns the number of values on the stack
+func (s *Stack[T]) Len() int {
+	return len(s.items)
+}
+
+// PushState saves a LexFn to be returned to later with PopState.
+// It's useful when the same construct can appear in several
+// states, e.g. an expression inside an interpolated string
+func (l *Lexer) PushState(fn LexFn) {
+	l.states.Push(fn)
+}
+
+// PopState removes the most recently pushed LexFn and returns
+// it. If there isn't one nil is returned, which stops lexing
+func (l *Lexer) PopState() LexFn {
+	fn, _ := l.states.Pop()
+	return fn
+}
@@ -0,0 +1,128 @@
+package rplex
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStack(t *testing.T) {
+	var s Stack[rune]
+
+	if _, ok := s.Pop(); ok {
+		t.Errorf("want Pop on an empty stack to fail")
+	}
+
+	if _, ok := s.Peek(); ok {
+		t.Errorf("want Peek on an empty stack to fail")
+	}
+
+	s.Push('(')
+	s.Push('[')
+
+	if v, _ := s.Peek(); v != '[' {
+		t.Errorf("have top '%c'; want '['", v)
+	}
+
+	if s.Len() != 2 {
+		t.Errorf("have length %d; want 2", s.Len())
+	}
+
+	for _, want := range "[(" {
+		v, ok := s.Pop()
+		if !ok || v != want {
+			t.Errorf("have (%c, %t); want (%c, true)", v, ok, want)
+		}
+	}
+
+	if v, ok := s.Pop(); ok || v != 0 {
+		t.Errorf("have (%c, %t); want zero value and false", v, ok)
+	}
+}
+
+func TestDataStack(t *testing.T) {
+	l := New("({[]})")
+	pairs := map[rune]rune{')': '(', '}': '{', ']': '['}
+
+	for r := l.Next(); l.Width > 0; r = l.Next() {
+		switch r {
+		case '(', '{', '[':
+			l.DataStack.Push(r)
+		default:
+			open, ok := l.DataStack.Pop()
+			if !ok || open.(rune) != pairs[r] {
+				t.Errorf("have unmatched '%c'", r)
+			}
+		}
+	}
+
+	if l.DataStack.Len() != 0 {
+		t.Errorf("have length %d; want 0", l.DataStack.Len())
+	}
+}
+
+func TestPushState(t *testing.T) {
+	var lexCode, lexString, lexExpr LexFn
+	emitPart := func(l *Lexer) {
+		if l.Pos > l.TokenStart {
+			l.Emit(&testToken{})
+		}
+	}
+
+	lexCode = func(l *Lexer) LexFn {
+		l.SkipWhitespace()
+		if l.Accept(`"`) {
+			l.Ignore()
+			l.PushState(lexCode)
+			return lexString
+		}
+		if l.AcceptIdentifier() {
+			l.Emit(&testToken{})
+			return lexCode
+		}
+		return l.PopState()
+	}
+
+	lexString = func(l *Lexer) LexFn {
+		for r := l.Next(); l.Width > 0; r = l.Next() {
+			if r == '"' {
+				l.Backup()
+				emitPart(l)
+				l.Accept(`"`)
+				l.Ignore()
+				return l.PopState()
+			}
+			if r == '$' && l.Peek() == '{' {
+				l.Backup()
+				emitPart(l)
+				l.AcceptString("${")
+				l.Ignore()
+				l.PushState(lexString)
+				return lexExpr
+			}
+		}
+		return nil
+	}
+
+	lexExpr = func(l *Lexer) LexFn {
+		l.SkipWhitespace()
+		if l.AcceptIdentifier() {
+			l.Emit(&testToken{})
+			return lexExpr
+		}
+		if l.Accept("}") {
+			l.Ignore()
+			return l.PopState()
+		}
+		return nil
+	}
+
+	var have []string
+	for _, tok := range New(`x "a ${y} b" z`).Run(lexCode) {
+		have = append(have, tok.Text())
+	}
+
+	want := []string{"x", "a ", "y", " b", "z"}
+	if strings.Join(have, "|") != strings.Join(want, "|") {
+		t.Errorf("have tokens %q; want %q", have, want)
+	}
+}
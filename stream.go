@@ -0,0 +1,149 @@
+package rplex
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// A TokenStream reads tokens one at a time, e.g. for a parser
+type TokenStream struct {
+	// KindName names kinds in the errors from Expect. If
+	// it's nil kinds are shown as numbers
+	KindName func(Kind) string
+
+	tokens []Token
+	pos    int
+	text   string
+	offset int
+	start  lineCol // The line and column at the start of text
+}
+
+// NewTokenStream returns a TokenStream that reads the provided tokens.
+// Errors give the byte offsets of tokens that are PosTokens
+func NewTokenStream(ts []Token) *TokenStream {
+	return &TokenStream{tokens: ts}
+}
+
+// Stream returns a TokenStream that reads the Lexer's tokens. Errors
+// give the lines and columns of tokens that are PosTokens as well as
+// their byte offsets
+func (l *Lexer) Stream() *TokenStream {
+	start := lineCol{0, 1, 1}
+	if l.base.line > 0 {
+		start = l.base
+	}
+
+	return &TokenStream{
+		tokens: l.Tokens,
+		text:   l.Text,
+		offset: l.Offset,
+		start:  start,
+	}
+}
+
+// Peek returns the next token without moving past it,
+// or nil if there are no more tokens
+func (s *TokenStream) Peek() Token {
+	if s.pos >= len(s.tokens) {
+		return nil
+	}
+	return s.tokens[s.pos]
+}
+
+// Next returns the next token and moves past it,
+// or returns nil if there are no more tokens
+func (s *TokenStream) Next() Token {
+	t := s.Peek()
+	if t != nil {
+		s.pos++
+	}
+	return t
+}
+
+// Backup moves back one token
+func (s *TokenStream) Backup() {
+	if s.pos > 0 {
+		s.pos--
+	}
+}
+
+// Accept moves past the next token and returns it if it's a
+// KindToken of kind k. Otherwise nil and false are returned
+func (s *TokenStream) Accept(k Kind) (Token, bool) {
+	kt, ok := s.Peek().(KindToken)
+	if !ok || kt.Kind() != k {
+		return nil, false
+	}
+	s.pos++
+	return kt, true
+}
+
+// Expect is like Accept but returns a *ParseError saying
+// what was expected and what was found instead
+func (s *TokenStream) Expect(k Kind) (Token, error) {
+	if t, ok := s.Accept(k); ok {
+		return t, nil
+	}
+
+	if s.Peek() == nil {
+		return nil, s.Errorf("expected %s, found end of input", s.kindName(k))
+	}
+	return nil, s.Errorf("expected %s, found %q", s.kindName(k), s.Peek().Text())
+}
+
+// kindName returns the name of k for error messages
+func (s *TokenStream) kindName(k Kind) string {
+	if s.KindName == nil {
+		return fmt.Sprintf("kind %d", k)
+	}
+	return s.KindName(k)
+}
+
+// A ParseError is an error at a token in a TokenStream
+type ParseError struct {
+	Token  Token  // The token the error is at, or nil at the end of the input
+	Msg    string // The message
+	Offset int    // The byte offset of the token, or -1 if it isn't known
+	Line   int    // The line the token starts on, or 0 if it isn't known
+	Column int    // The column the token starts at, or 0 if it isn't known
+}
+
+// Error returns the message along with where the error is
+func (e *ParseError) Error() string {
+	switch {
+	case e.Line > 0:
+		return fmt.Sprintf("%d:%d: %s", e.Line, e.Column, e.Msg)
+	case e.Offset >= 0:
+		return fmt.Sprintf("byte %d: %s", e.Offset, e.Msg)
+	}
+	return e.Msg
+}
+
+// Errorf returns a *ParseError at the next token with a message
+// formatted according to a format specifier
+func (s *TokenStream) Errorf(format string, args ...interface{}) error {
+	e := &ParseError{
+		Token:  s.Peek(),
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: -1,
+	}
+
+	if pt, ok := e.Token.(PosToken); ok {
+		e.Offset, _ = pt.Pos()
+	} else if e.Token == nil && s.text != "" {
+		e.Offset = len(s.text) + s.offset
+	}
+
+	// The text before the token may have been discarded
+	// by WithWindow, leaving only the byte offset
+	if pos := e.Offset - s.offset; s.text != "" && e.Offset >= 0 && pos >= 0 && pos <= len(s.text) {
+		lineStart := strings.LastIndexByte(s.text[:pos], '\n') + 1
+		e.Line = s.start.line + strings.Count(s.text[:pos], "\n")
+		e.Column = utf8.RuneCountInString(s.text[lineStart:pos]) + 1
+		if lineStart == 0 {
+			e.Column += s.start.col - 1
+		}
+	}
+	return e
+}
@@ -0,0 +1,121 @@
+package rplex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+type streamToken struct {
+	TextToken
+	TypedToken
+	PositionedToken
+}
+
+const (
+	kindIdent Kind = iota
+	kindEquals
+	kindInt
+)
+
+func lexAssignments(l *Lexer) LexFn {
+	for {
+		l.SkipWhitespace()
+		switch {
+		case l.AtEOF():
+			return nil
+		case l.AcceptIdentifier():
+			l.EmitKind(&streamToken{}, kindIdent)
+		case l.Accept("="):
+			l.EmitKind(&streamToken{}, kindEquals)
+		default:
+			l.AcceptRunFunc(IsASCIIDigit)
+			l.EmitKind(&streamToken{}, kindInt)
+		}
+	}
+}
+
+func TestTokenStream(t *testing.T) {
+	l := New("a = 1\nbé = = 2")
+	l.Run(lexAssignments)
+
+	s := l.Stream()
+	s.KindName = func(k Kind) string {
+		return []string{"identifier", "'='", "integer"}[k]
+	}
+
+	var parsed []string
+	for s.Peek() != nil {
+		name, err := s.Expect(kindIdent)
+		if err == nil {
+			_, err = s.Expect(kindEquals)
+		}
+		if err == nil {
+			_, err = s.Expect(kindInt)
+		}
+
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Offset != 12 {
+				t.Fatalf("have error %#v; want a ParseError at byte 12", err)
+			}
+			if err.Error() != "2:6: expected integer, found \"=\"" {
+				t.Errorf("have error '%s'", err)
+			}
+			break
+		}
+		parsed = append(parsed, name.Text())
+	}
+
+	if len(parsed) != 1 || parsed[0] != "a" {
+		t.Errorf("have parsed %q; want just 'a'", parsed)
+	}
+
+	if _, ok := s.Accept(kindInt); ok {
+		t.Errorf("want Accept to be false for the wrong kind")
+	}
+	if _, ok := s.Accept(kindEquals); !ok {
+		t.Errorf("want Accept to be true for the right kind")
+	}
+
+	s.Next()
+	if s.Peek() != nil || s.Next() != nil {
+		t.Errorf("want nil at the end of the stream")
+	}
+
+	s.Backup()
+	if s.Peek().Text() != "2" {
+		t.Errorf("have '%s' after Backup; want '2'", s.Peek().Text())
+	}
+
+	s.Next()
+	_, err := s.Expect(kindIdent)
+	if err == nil || err.Error() != "2:9: expected identifier, found end of input" {
+		t.Errorf("have error '%v'; want '2:9: expected identifier, found end of input'", err)
+	}
+
+	err = NewTokenStream(l.Tokens[:1]).Errorf("oops")
+	if err.Error() != "byte 0: oops" {
+		t.Errorf("have error '%s'; want 'byte 0: oops'", err)
+	}
+}
+
+func TestTokenStreamWindow(t *testing.T) {
+	input := strings.Repeat("a = 1\n", 5000) + "b = c"
+	l := NewReader(strings.NewReader(input), WithWindow(16))
+	l.Run(lexAssignments)
+
+	err := l.Stream().Errorf("oops")
+	if err.Error() != "byte 0: oops" {
+		t.Errorf("have error '%s'; want 'byte 0: oops'", err)
+	}
+
+	s := l.Stream()
+	for s.Peek().Text() != "c" {
+		s.Next()
+	}
+	err = s.Errorf("oops")
+	if err.Error() != "5001:5: oops" {
+		t.Errorf("have error '%s'; want '5001:5: oops'", err)
+	}
+}
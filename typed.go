@@ -0,0 +1,128 @@
+package rplex
+
+import "fmt"
+
+// A TypedLexer is a Lexer whose tokens all have the concrete type T,
+// so that they're held in a []T and can be used without type
+// assertions. It has all of a Lexer's methods for reading the input,
+// but only its own Emit methods add to its Tokens. Anything emitted
+// with the embedded Lexer's methods, including the ErrorTokens for
+// limits and from Errorf, goes to the embedded Lexer's Tokens as usual.
+//
+// Like a ByteLexer it has a smaller set of features than a Lexer:
+// tokens aren't passed to OnEmit hooks or WithDedupeConsecutive,
+// and Run doesn't trace LexFns, record a state graph, check for
+// stalls or emit the token from WithEOFToken
+type TypedLexer[T Token] struct {
+	*Lexer
+	Tokens []T // The tokens that have been emitted
+}
+
+// A TypedLexFn is like a LexFn, but for a TypedLexer
+type TypedLexFn[T Token] func(*TypedLexer[T]) TypedLexFn[T]
+
+// NewTyped returns a new TypedLexer for the provided input text
+func NewTyped[T Token](text string, opts ...Option) *TypedLexer[T] {
+	return &TypedLexer[T]{
+		Lexer:  New(text, opts...),
+		Tokens: make([]T, 0),
+	}
+}
+
+// Reset makes the TypedLexer ready to lex new input text
+// like Lexer.Reset, keeping the memory of its token slice
+func (l *TypedLexer[T]) Reset(text string) {
+	clear(l.Tokens)
+	l.Tokens = l.Tokens[:0]
+	l.Lexer.Reset(text)
+}
+
+// Run runs the lexer and returns the lexed tokens. It stops
+// early if lexing is halted, e.g. by a limit being exceeded
+func (l *TypedLexer[T]) Run(initial TypedLexFn[T]) []T {
+	for lexfn := initial; lexfn != nil && l.err == nil; {
+		lexfn = lexfn(l)
+	}
+	return l.Tokens
+}
+
+// Emit adds the current token to the token slice and
+// moves the tokenStart pointer to the current position.
+// If the token is a PosToken its position is set too
+func (l *TypedLexer[T]) Emit(t T) {
+	l.EmitText(t, l.Pending())
+}
+
+// EmitText emits the current token like Emit, but with the
+// provided text instead of the text from the input
+func (l *TypedLexer[T]) EmitText(t T, text string) {
+	if l.maxTokenLen > 0 && l.Pos-l.TokenStart > l.maxTokenLen {
+		if l.err == nil {
+			l.exceeded("token length", l.maxTokenLen)
+		}
+		return
+	}
+	if l.maxTokens > 0 && l.emitted >= l.maxTokens {
+		if l.err == nil {
+			l.exceeded("token count", l.maxTokens)
+		}
+		return
+	}
+
+	start := l.TokenStart
+	t.SetText(text)
+	l.setPos(t, start, l.Pos)
+	l.setLineCol(t, start)
+	l.TokenStart = l.Pos
+	l.snapshotLineCol()
+
+	if tt, ok := Token(t).(TriviaToken); ok {
+		tt.SetLeadingTrivia(l.trivia)
+	}
+	l.trivia = ""
+
+	if l.trace != nil {
+		fmt.Fprintf(l.trace, "rplex: emit %T %q at byte %d\n", t, t.Text(), start+l.Offset)
+	}
+
+	l.emitted++
+	l.unEmit = -1
+	l.Tokens = append(l.Tokens, t)
+}
+
+// LastToken returns the most recently emitted token,
+// or the zero T if no tokens have been emitted
+func (l *TypedLexer[T]) LastToken() T {
+	if len(l.Tokens) == 0 {
+		var zero T
+		return zero
+	}
+	return l.Tokens[len(l.Tokens)-1]
+}
+
+// A TypedCheckpoint is a saved TypedLexer state that
+// can be returned to with Restore
+type TypedCheckpoint struct {
+	cp     Checkpoint
+	tokens int
+}
+
+// Checkpoint saves the current state of the TypedLexer
+// so that it can be returned to with Restore
+func (l *TypedLexer[T]) Checkpoint() TypedCheckpoint {
+	return TypedCheckpoint{l.Lexer.Checkpoint(), len(l.Tokens)}
+}
+
+// Restore returns the TypedLexer to the state saved in a
+// TypedCheckpoint like Lexer.Restore, removing any tokens
+// emitted since the TypedCheckpoint was made
+func (l *TypedLexer[T]) Restore(cp TypedCheckpoint) error {
+	if err := l.Lexer.Restore(cp.cp); err != nil {
+		return err
+	}
+	if cp.tokens < len(l.Tokens) {
+		clear(l.Tokens[cp.tokens:])
+		l.Tokens = l.Tokens[:cp.tokens]
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package rplex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode"
+)
+
+func lexTypedWords(l *TypedLexer[*posToken]) TypedLexFn[*posToken] {
+	l.SkipSpaces()
+	if l.Peek() == EOF {
+		return nil
+	}
+	l.AcceptRunFunc(unicode.IsLetter)
+	l.Emit(&posToken{})
+	return lexTypedWords
+}
+
+func TestTypedLexer(t *testing.T) {
+	l := NewTyped[*posToken]("one two three")
+	ts := l.Run(lexTypedWords)
+
+	if len(ts) != 3 {
+		t.Fatalf("have %d tokens; want 3", len(ts))
+	}
+	if ts[1].Text() != "two" || ts[1].start != 4 || ts[1].end != 7 {
+		t.Errorf("have %q at %d-%d; want 'two' at 4-7", ts[1].Text(), ts[1].start, ts[1].end)
+	}
+	if len(l.Lexer.Tokens) != 0 {
+		t.Errorf("have %d tokens in the embedded Lexer; want 0", len(l.Lexer.Tokens))
+	}
+
+	l.Reset("four")
+	if ts = l.Run(lexTypedWords); len(ts) != 1 || l.LastToken().Text() != "four" {
+		t.Errorf("have tokens %v after Reset; want just 'four'", ts)
+	}
+}
+
+func TestTypedLexerCheckpoint(t *testing.T) {
+	l := NewTyped[*posToken]("ab12")
+	l.Accept("a")
+	l.Emit(&posToken{})
+	cp := l.Checkpoint()
+
+	l.Accept("b")
+	l.Emit(&posToken{})
+	if err := l.Restore(cp); err != nil {
+		t.Fatalf("have error %v; want nil", err)
+	}
+
+	l.AcceptRun("b12")
+	l.Emit(&posToken{})
+	if len(l.Tokens) != 2 || l.Tokens[1].Text() != "b12" {
+		t.Errorf("have tokens %v; want 'a' and 'b12'", l.Tokens)
+	}
+}
+
+func TestTypedLexerLimits(t *testing.T) {
+	l := NewTyped[*posToken]("a b c", WithMaxTokens(2))
+	ts := l.Run(lexTypedWords)
+
+	if !errors.Is(l.Err(), ErrLimit) || len(ts) != 2 {
+		t.Errorf("have %d tokens and error %v; want 2 and ErrLimit", len(ts), l.Err())
+	}
+
+	// The ErrorToken isn't a T, so the embedded Lexer holds it
+	if len(l.Lexer.Tokens) != 1 {
+		t.Fatalf("have %d tokens in the embedded Lexer; want 1", len(l.Lexer.Tokens))
+	}
+	if _, ok := l.Lexer.Tokens[0].(*ErrorToken); !ok {
+		t.Errorf("have %T; want *ErrorToken", l.Lexer.Tokens[0])
+	}
+}
+
+func BenchmarkTypedLexer(b *testing.B) {
+	input := strings.Repeat("lorem ipsum dolor sit amet ", 100)
+	b.ReportAllocs()
+	l := NewTyped[*posToken]("")
+	for i := 0; i < b.N; i++ {
+		l.Reset(input)
+		l.Run(lexTypedWords)
+	}
+}
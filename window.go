@@ -0,0 +1,102 @@
+package rplex
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrDiscarded is returned by Restore when the input at
+// a Checkpoint has been discarded by WithWindow
+var ErrDiscarded = errors.New("rplex: input at checkpoint has been discarded")
+
+// WithWindow makes a Lexer from NewReader discard input it no longer
+// needs before reading more, so that memory use is bounded by the
+// longest token rather than the length of the input. The current and
+// last emitted tokens are always kept, along with at least n bytes
+// before the current position so that Backup, BackupN and Restore
+// work within that window. BackupN returns false, and Restore returns
+// ErrDiscarded, for positions before it.
+//
+// Text only holds the input that hasn't been discarded, and positions
+// in it are relative to its start. The number of bytes discarded is
+// added to Offset, so positions given to PosTokens are still byte
+// offsets into the whole input. The option has no effect for lexers
+// from New, which already hold all of their input
+func WithWindow(n int) Option {
+	return func(l *Lexer) {
+		l.window = n
+	}
+}
+
+// WithLookahead makes a Lexer from NewReader discard input it no
+// longer needs like WithWindow, but keeps at least n runes before
+// the current position rather than a number of bytes. Restore works
+// for Checkpoints within n runes of the current position, and
+// returns ErrDiscarded for ones before that. BackupN works for at
+// least n runes too
+func WithLookahead(n int) Option {
+	return func(l *Lexer) {
+		l.lookahead = n
+		l.window = max(l.window, 0)
+	}
+}
+
+// discard drops the start of Text up to the earliest position the
+// Lexer still needs, adjusting every position in the Lexer to match
+func (l *Lexer) discard() {
+	cut := l.Pos - l.window
+	keep := []int{
+		// The rune before the current token is
+		// needed to tell if it's at a line start
+		l.TokenStart - 1,
+		l.Pos - l.hist.bytes(l.hist.len),
+	}
+	if len(l.Tokens) > 0 {
+		keep = append(keep, l.lastStart)
+	}
+	if l.unEmit >= 0 {
+		keep = append(keep, l.unEmit)
+		if len(l.Tokens) > 1 {
+			keep = append(keep, l.prevStart)
+		}
+	}
+
+	back := l.Pos
+	for i := 0; i < l.lookahead && back > 0; i++ {
+		_, w := utf8.DecodeLastRuneInString(l.Text[:back])
+		back -= w
+	}
+	keep = append(keep, back)
+
+	for _, p := range keep {
+		cut = min(cut, p)
+	}
+
+	// Cutting part way through a rune would
+	// count it twice in the line and column
+	for cut > 0 && cut < len(l.Text) && !utf8.RuneStart(l.Text[cut]) {
+		cut--
+	}
+
+	if cut <= 0 {
+		return
+	}
+
+	line, col := l.lineColAt(cut)
+	l.base = lineCol{0, line, col}
+	l.lc = l.base
+
+	l.cutRunes += utf8.RuneCountInString(l.Text[:cut])
+	l.Text = l.Text[cut:]
+	l.Pos -= cut
+	l.TokenStart -= cut
+	l.lastStart -= cut
+	l.prevStart -= cut
+	if l.unEmit >= 0 {
+		l.unEmit -= cut
+	}
+	l.invalidSeen = max(l.invalidSeen-cut, 0)
+	l.Offset += cut
+	l.discarded += cut
+	l.runeLen = -1
+}
@@ -0,0 +1,190 @@
+package rplex
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+type windowToken struct {
+	PositionedToken
+	lineColToken
+}
+
+func TestWithWindow(t *testing.T) {
+	line := "alpha beta gamma\n"
+	input := strings.Repeat(line, 5000)
+
+	l := NewReader(strings.NewReader(input), WithWindow(16))
+	start := l.Checkpoint()
+
+	maxText := 0
+	n := 0
+	for {
+		l.SkipSpaces()
+		if l.AtEOF() {
+			break
+		}
+		l.AcceptRunFunc(IsASCIILetter)
+		tok := &windowToken{}
+		l.Emit(tok)
+
+		// Check a sample of the tokens against the whole input
+		if n%997 == 0 {
+			s, e := tok.Pos()
+			if input[s:e] != tok.Text() {
+				t.Errorf("have token %q at %d-%d; want %q", tok.Text(), s, e, input[s:e])
+			}
+			if wantLine := strings.Count(input[:s], "\n") + 1; tok.line != wantLine {
+				t.Errorf("have token %q on line %d; want %d", tok.Text(), tok.line, wantLine)
+			}
+			if wantCol := s - strings.LastIndexByte(input[:s], '\n'); tok.col != wantCol {
+				t.Errorf("have token %q at column %d; want %d", tok.Text(), tok.col, wantCol)
+			}
+		}
+		n++
+		l.Tokens = l.Tokens[:0]
+		maxText = max(maxText, len(l.Text))
+	}
+
+	if n != 15000 {
+		t.Errorf("have %d tokens; want 15000", n)
+	}
+
+	if maxText > 3*minReadSize {
+		t.Errorf("have up to %d bytes held; want the input to be discarded", maxText)
+	}
+
+	if err := l.Restore(start); !errors.Is(err, ErrDiscarded) {
+		t.Errorf("have error %v restoring to the start; want ErrDiscarded", err)
+	}
+}
+
+func TestWithWindowBacktracking(t *testing.T) {
+	input := strings.Repeat("x", 3*minReadSize)
+	l := NewReader(strings.NewReader(input), WithWindow(8))
+
+	l.Next()
+	l.Ignore()
+	cp := l.Checkpoint()
+
+	for i := 0; i < 2*minReadSize; i++ {
+		l.Next()
+		l.Ignore()
+	}
+
+	if l.Offset == 0 {
+		t.Fatalf("want some input to have been discarded")
+	}
+
+	if err := l.Restore(cp); !errors.Is(err, ErrDiscarded) {
+		t.Errorf("have error %v; want ErrDiscarded", err)
+	}
+
+	if !l.BackupN(8) {
+		t.Errorf("want BackupN within the window to succeed")
+	}
+
+	cp = l.Checkpoint()
+	for i := 0; i < 4; i++ {
+		l.Next()
+	}
+	if err := l.Restore(cp); err != nil {
+		t.Errorf("have error %v restoring within the window; want nil", err)
+	}
+
+	want := 2*minReadSize + 1 - 8
+	if l.Pos+l.Offset != want {
+		t.Errorf("have absolute position %d; want %d", l.Pos+l.Offset, want)
+	}
+}
+
+func TestWithWindowMultibyte(t *testing.T) {
+	// Lines are longer than the window so that columns
+	// are counted from where the input was discarded
+	input := strings.Repeat(strings.Repeat("aé éé çé ab ", 50)+"\n", 40)
+
+	lex := func(l *Lexer) []Token {
+		return l.Run(func(l *Lexer) LexFn {
+			for {
+				// Backing up has the column recounted
+				if l.Next() == EOF {
+					return nil
+				}
+				l.Peek()
+				l.Emit(&lineColToken{})
+			}
+		})
+	}
+
+	want := lex(New(input))
+	l := NewReader(strings.NewReader(input), WithWindow(100))
+	have := lex(l)
+
+	if len(have) != len(want) {
+		t.Fatalf("have %d tokens; want %d", len(have), len(want))
+	}
+
+	for i := range want {
+		h, w := have[i].(*lineColToken), want[i].(*lineColToken)
+		if h.line != w.line || h.col != w.col {
+			t.Fatalf("have token %d %q at %d:%d; want %d:%d", i, h.Text(), h.line, h.col, w.line, w.col)
+		}
+	}
+
+	if l.ByteLen() != len(input) {
+		t.Errorf("have ByteLen %d; want %d", l.ByteLen(), len(input))
+	}
+	if want := utf8.RuneCountInString(input); l.RuneLen() != want {
+		t.Errorf("have RuneLen %d; want %d", l.RuneLen(), want)
+	}
+}
+
+func TestWithLookahead(t *testing.T) {
+	input := strings.Repeat("é", 3*minReadSize)
+	l := NewReader(strings.NewReader(input), WithLookahead(100))
+	start := l.Checkpoint()
+
+	for !l.AtEOF() {
+		// Ignoring the runes means only the lookahead keeps them
+		cp := l.Checkpoint()
+		for i := 0; i < 100; i++ {
+			l.Next()
+			l.Ignore()
+		}
+		if err := l.Restore(cp); err != nil {
+			t.Fatalf("have error %v restoring 100 runes back; want nil", err)
+		}
+
+		for i := 0; i < 100; i++ {
+			l.Next()
+		}
+		l.Ignore()
+	}
+
+	if l.Offset == 0 {
+		t.Errorf("want some input to have been discarded")
+	}
+
+	if err := l.Restore(start); !errors.Is(err, ErrDiscarded) {
+		t.Errorf("have error %v restoring to the start; want ErrDiscarded", err)
+	}
+
+	// Lexers that remember runes rather than decoding
+	// them again must remember as many as the lookahead
+	for _, mode := range []InvalidMode{InvalidReplace, InvalidSkip} {
+		l = NewReader(strings.NewReader(input), WithLookahead(100), WithInvalidRune(mode))
+		for i := 0; i < 2*minReadSize; i++ {
+			l.Next()
+			l.Ignore()
+		}
+		pos := l.Pos
+		if !l.BackupN(50) {
+			t.Fatalf("want BackupN(50) to succeed with mode %d", mode)
+		}
+		if l.Pos != pos-100 || l.Cur != 'é' {
+			t.Errorf("have pos %d, cur '%c' with mode %d; want %d, 'é'", l.Pos, l.Cur, mode, pos-100)
+		}
+	}
+}